@@ -0,0 +1,110 @@
+package ratelimiter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// BucketKey identifies a set of rate limits
+// Application buckets only use the Platform, service buckets the Platform and Service, method buckets the Platform, Service and Method
+// tenant buckets the Platform and Tenant, and the buckets of a LabelLevel the Platform and Label
+type BucketKey struct {
+	Platform string    `json:"platform"`
+	Service  string    `json:"service,omitempty"`
+	Method   string    `json:"method,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Label    string    `json:"label,omitempty"`
+	Scope    LimitType `json:"scope"`
+}
+
+// BucketState holds everything known about a bucket
+type BucketState struct {
+	// Limits and their windows, as last reported by the API
+	Limits []RateLimits
+	// Reservations for requests that haven't reported back yet and haven't expired
+	Leases []Lease
+	// No request may be sent before this time, set after a 429 (zero if not blocked)
+	BlockedUntil time.Time
+}
+
+// BucketCheck is a bucket checked by Store.CheckAndReserve, along with the headroom to leave unused in its windows
+type BucketCheck struct {
+	Key    BucketKey
+	Margin SafetyMargin
+	// Number of requests to leave unused on top of the margin, for waiting requests of higher priorities
+	Held int
+	// Number of requests to leave unused on top of Held in the limit of each window duration, for the unused guaranteed shares of tenants
+	HeldInWindow map[time.Duration]int
+}
+
+// Returns the number of requests the check leaves unused in a limit, on top of its margin
+func (c BucketCheck) held(limit RateLimits) int {
+	return c.Held + c.HeldInWindow[limit.Duration]
+}
+
+// Lease is a reservation that is reclaimed automatically if it isn't released before it expires
+type Lease struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Returns the number of reservations held on the bucket
+func (s BucketState) Reserved() int {
+	return len(s.Leases)
+}
+
+// Returns how long the bucket is still blocked at the given time
+func (s BucketState) blockWait(now time.Time) time.Duration {
+	return max(s.BlockedUntil.Sub(now), 0)
+}
+
+// Creates a new lease with a random ID
+func newLease(expiresAt time.Time) Lease {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return Lease{ID: hex.EncodeToString(id), ExpiresAt: expiresAt}
+}
+
+// Checks if the lease has expired at the given time
+func (l Lease) expired(now time.Time) bool {
+	return !now.Before(l.ExpiresAt)
+}
+
+// Returns the key as a string, e.g. "NA1" for an application bucket, "NA1:SUMMONER" for a service bucket,
+// "NA1:SUMMONER:GET_BY_PUUID" for a method bucket, "NA1:tenant:example" for a tenant bucket
+// or "NA1:user:1234" for the bucket of a LabelLevel named "user"
+func (k BucketKey) String() string {
+	if k.Label != "" {
+		return k.Platform + ":" + string(k.Scope) + ":" + k.Label
+	}
+	switch k.Scope {
+	case LIMIT_TYPE_TENANT:
+		return k.Platform + ":" + string(k.Scope) + ":" + k.Tenant
+	case LIMIT_TYPE_APPLICATION:
+		return k.Platform
+	case LIMIT_TYPE_METHOD:
+		return k.Platform + ":" + k.Service + ":" + k.Method
+	case LIMIT_TYPE_SERVICE:
+		return k.Platform + ":" + k.Service
+	}
+	return k.Platform + ":" + k.Service + ":" + k.Method + ":" + string(k.Scope)
+}
+
+// Returns the key of the bucket for the given scope
+func (d *RateLimitDetails) bucketKey(scope LimitType) BucketKey {
+	switch scope {
+	case LIMIT_TYPE_APPLICATION:
+		return BucketKey{Platform: d.PlatformName, Scope: scope}
+	case LIMIT_TYPE_SERVICE:
+		return BucketKey{Platform: d.PlatformName, Service: d.ServiceName, Scope: scope}
+	case LIMIT_TYPE_TENANT:
+		return BucketKey{Platform: d.PlatformName, Tenant: d.TenantName, Scope: scope}
+	}
+	return BucketKey{Platform: d.PlatformName, Service: d.ServiceName, Method: d.MethodName, Scope: scope}
+}
+
+// Returns the keys of the application and method buckets
+func (d *RateLimitDetails) bucketKeys() (BucketKey, BucketKey) {
+	return d.bucketKey(LIMIT_TYPE_APPLICATION), d.bucketKey(LIMIT_TYPE_METHOD)
+}
@@ -0,0 +1,156 @@
+package ratelimiter
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock tells the RateLimiter and the stores what time it is, and lets Wait sleep
+// Swap in a FakeClock to simulate time in tests
+type Clock interface {
+	// Returns the current time
+	Now() time.Time
+	// Creates a Timer that fires once d has passed
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single-shot timer created by a Clock
+type Timer interface {
+	// Returns the channel the time is sent on when the timer fires
+	C() <-chan time.Time
+	// Stops the timer, returns false if it already fired or was stopped
+	Stop() bool
+}
+
+// The Clock used by default, reading the system time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+// A Timer backed by a timer of the time package
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+var _ Clock = (*FakeClock)(nil)
+
+// FakeClock is a Clock that only moves when told to, for deterministic tests and simulations
+// Its timers fire as soon as Advance moves the time past them, so hours of traffic can be simulated in milliseconds
+// It is safe for concurrent use
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// Closed and replaced whenever a timer is added, see BlockUntilTimers
+	changed chan struct{}
+}
+
+// A Timer created by a FakeClock
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+// Creates a FakeClock starting at the given time
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start, changed: make(chan struct{})}
+}
+
+// Returns the current time of the clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Creates a Timer firing once the clock is advanced by d, or right away if d is not positive
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+
+	c.timers = append(c.timers, t)
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer whose deadline is reached in order of their deadlines
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	slices.SortStableFunc(c.timers, func(a *fakeTimer, b *fakeTimer) int {
+		return a.deadline.Compare(b.deadline)
+	})
+
+	fired := 0
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			break
+		}
+		t.c <- c.now
+		fired++
+	}
+	c.timers = slices.Delete(c.timers, 0, fired)
+}
+
+// Timers returns the number of timers that are waiting to fire
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntilTimers blocks until at least n timers are waiting to fire
+// Use it to wait for goroutines to go to sleep before advancing the clock
+func (c *FakeClock) BlockUntilTimers(n int) {
+	for {
+		c.mu.Lock()
+		count, changed := len(c.timers), c.changed
+		c.mu.Unlock()
+
+		if count >= n {
+			return
+		}
+		<-changed
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	index := slices.Index(t.clock.timers, t)
+	if index < 0 {
+		return false
+	}
+	t.clock.timers = slices.Delete(t.clock.timers, index, index+1)
+	return true
+}
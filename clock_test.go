@@ -0,0 +1,105 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2025, 7, 22, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	late := clock.NewTimer(2 * time.Second)
+	early := clock.NewTimer(time.Second)
+	stopped := clock.NewTimer(time.Second)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Errorf("Expected only the first Stop of a pending timer to succeed")
+	}
+
+	select {
+	case <-clock.NewTimer(0).C():
+	default:
+		t.Errorf("Expected a timer without a duration to fire right away")
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	select {
+	case fired := <-early.C():
+		if !fired.Equal(start.Add(1500 * time.Millisecond)) {
+			t.Errorf("Expected the timer to fire with the current time, got %v", fired)
+		}
+	default:
+		t.Errorf("Expected the early timer to fire")
+	}
+	if clock.Timers() != 1 {
+		t.Errorf("Expected only the late timer to be pending, got %d", clock.Timers())
+	}
+
+	clock.Advance(time.Second)
+	if len(late.C()) != 1 || late.Stop() {
+		t.Errorf("Expected the late timer to have fired")
+	}
+	if len(stopped.C()) != 0 {
+		t.Errorf("Expected the stopped timer to never fire")
+	}
+}
+
+func TestWaitOnFakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	rl := NewRateLimiter(NewStoreWithClock(clock), WithClock(clock))
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 1, Counts: 1, Duration: time.Hour, LastAt: clock.Now(), WindowStart: clock.Now()},
+	})
+
+	done := make(chan error)
+	go func() {
+		reservation, err := rl.Wait(context.Background(), testUrl, "GET", LIMIT_STRATEGY_BURST)
+		if err == nil {
+			reservation.Cancel()
+		}
+		done <- err
+	}()
+
+	// The waiter sleeps until the window resets an hour later, which takes no time at all
+	clock.BlockUntilTimers(1)
+	clock.Advance(time.Hour)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSimulatedTraffic(t *testing.T) {
+	clock := NewFakeClock(time.Date(2025, 7, 22, 12, 0, 0, 0, time.UTC))
+	rl := NewRateLimiter(NewStoreWithClock(clock), WithClock(clock),
+		WithDefaultLimits([]RateLimits{{Limit: 20, Duration: 10 * time.Second}}, nil))
+
+	// Sends requests as fast as the limits allow for a simulated hour, counting them per window
+	start := clock.Now()
+	perWindow := map[int]int{}
+	for clock.Now().Sub(start) < time.Hour {
+		reservation, wait, err := rl.TryReserve(testUrl, "GET")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reservation == nil {
+			clock.Advance(wait)
+			continue
+		}
+
+		perWindow[int(clock.Now().Sub(start)/(10*time.Second))]++
+		if err := reservation.Complete(http.Header{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if len(perWindow) != 360 {
+		t.Errorf("Expected requests in each of the 360 windows, got %d", len(perWindow))
+	}
+	for window, count := range perWindow {
+		if count != 20 {
+			t.Errorf("Expected 20 requests in window %d, got %d", window, count)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package ratelimiter
 
+import "time"
+
 // METHODS defines the Riot API endpoints organized by service
 var METHODS = map[string]map[string]string{
 	"ACCOUNT": {
@@ -154,6 +156,8 @@ type LimitType string
 const (
 	LIMIT_TYPE_APPLICATION LimitType = "application"
 	LIMIT_TYPE_METHOD      LimitType = "method"
+	LIMIT_TYPE_SERVICE     LimitType = "service"
+	LIMIT_TYPE_TENANT      LimitType = "tenant"
 )
 
 type LimitStrategy string
@@ -162,3 +166,25 @@ const (
 	LIMIT_STRATEGY_SPREAD LimitStrategy = "spread"
 	LIMIT_STRATEGY_BURST  LimitStrategy = "burst"
 )
+
+// Priority orders requests competing for the same slots, higher priorities go first
+// Any int works, these are the usual levels
+type Priority int
+
+const (
+	PRIORITY_LOW    Priority = -1
+	PRIORITY_NORMAL Priority = 0
+	PRIORITY_HIGH   Priority = 1
+)
+
+// Number of new buckets tracked between two passes forgetting the buckets that left the store
+const PRUNE_TRACKED_EVERY = 1024
+
+// How long a reservation is held before it is reclaimed, unless it is completed or cancelled first
+const DEFAULT_LEASE_DURATION = time.Minute
+
+// Backoff after the first service 429, doubling with every consecutive one up to SERVICE_BACKOFF_MAX
+const (
+	SERVICE_BACKOFF_BASE = time.Second
+	SERVICE_BACKOFF_MAX  = time.Minute
+)
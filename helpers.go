@@ -2,10 +2,12 @@ package ratelimiter
 
 import (
 	"errors"
+	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // RateLimitPair represents a pair of numbers
@@ -18,6 +20,10 @@ type RateLimitDetails struct {
 	PlatformName string
 	ServiceName  string
 	MethodName   string
+	// Tenant the request is made for, empty if none
+	TenantName string
+	// Labels of the request, used by the levels added with LabelLevel
+	Labels map[string]string
 }
 
 // Parses the ratelimit header string
@@ -58,6 +64,185 @@ func parseHeader(input string) ([]RateLimitPair, error) {
 	return pairs, nil
 }
 
+// Builds rate limits from a pair of limit and count headers, e.g. X-App-Rate-Limit and X-App-Rate-Limit-Count
+// They are stamped with the time the request was sent
+// Returns nil if the limit header is missing, and an error naming the header if one is malformed
+func limitsFromHeaders(headers http.Header, limitHeader string, countHeader string, retryAfter time.Duration, sentAt time.Time) ([]RateLimits, error) {
+	limitValue := headers.Get(limitHeader)
+	if limitValue == "" {
+		return nil, nil
+	}
+
+	limitPairs, err := parseHeader(limitValue)
+	if err != nil {
+		return nil, errors.New("invalid " + limitHeader + " header: " + err.Error())
+	}
+
+	countPairs, err := parseHeader(headers.Get(countHeader))
+	if err != nil {
+		return nil, errors.New("invalid " + countHeader + " header: " + err.Error())
+	}
+
+	limits := make([]RateLimits, 0, len(limitPairs))
+	for i, limitPair := range limitPairs {
+		rateLimits := RateLimits{
+			Limit:      limitPair.Limit,
+			Duration:   time.Duration(limitPair.Duration) * time.Second,
+			RetryAfter: retryAfter,
+			LastAt:     sentAt,
+		}
+
+		if i < len(countPairs) {
+			rateLimits.Counts = countPairs[i].Limit
+		}
+
+		limits = append(limits, rateLimits)
+	}
+
+	return limits, nil
+}
+
+// Returns a copy of the current limits with one more request, sent at the given time, counted
+// A limit whose window already reset by then starts the next one with this request
+func countRequest(current []RateLimits, sentAt time.Time) []RateLimits {
+	counted := make([]RateLimits, len(current))
+
+	for i, limit := range current {
+		if sentAt.Before(limit.ResetAt()) {
+			limit.Counts++
+		} else {
+			limit.Counts, limit.WindowStart = 1, sentAt
+		}
+		limit.LastAt = latest(limit.LastAt, sentAt)
+		counted[i] = limit
+	}
+
+	return counted
+}
+
+// Returns a copy of new limits merged into the current ones, counting the request they were learned from
+// The LastAt of the new limits is the time that request was sent, so responses arriving out of order still merge correctly
+// For each new limit, the current limit with the same duration decides:
+//   - If the request was sent after its window reset, or it has a count of 1 and was sent after its window started,
+//     the request started a new window
+//   - Otherwise the request belongs to its window, which keeps its start, and the higher count wins
+//     A request sent after the latest one counted is also counted locally, so an older response can never lower the count,
+//     while the count of a request sent before it already includes the request and is taken as is
+//   - A request with a count of 1 sent less than a window before the latest one started the window,
+//     if its start was only assumed from the latest request (see below)
+//
+// Without a current limit the start is unknown, and the window is assumed to start with the request so it never resets too early
+func reconcileLimits(current []RateLimits, limits []RateLimits) []RateLimits {
+	merged := make([]RateLimits, len(limits))
+
+	for i, limit := range limits {
+		limit.WindowStart = limit.LastAt
+		for _, currentLimit := range current {
+			if currentLimit.Duration != limit.Duration {
+				continue
+			}
+
+			currentStart := currentLimit.ResetAt().Add(-currentLimit.Duration)
+			newWindow := !limit.LastAt.Before(currentLimit.ResetAt()) || (limit.Counts == 1 && limit.LastAt.After(currentStart))
+			if !newWindow {
+				assumedStart := currentLimit.Counts > 1 && currentLimit.WindowStart.Equal(currentLimit.LastAt)
+				startedWindow := assumedStart && limit.Counts == 1 && limit.LastAt.Before(currentStart) && currentLimit.LastAt.Before(limit.LastAt.Add(limit.Duration))
+				if !startedWindow {
+					limit.WindowStart = currentStart
+				}
+				if limit.LastAt.After(currentLimit.LastAt) {
+					limit.Counts = max(limit.Counts, currentLimit.Counts+1)
+				} else {
+					limit.Counts = max(limit.Counts, currentLimit.Counts)
+				}
+			}
+			limit.LastAt = latest(limit.LastAt, currentLimit.LastAt)
+			break
+		}
+		merged[i] = limit
+	}
+
+	return merged
+}
+
+// Returns the later of two times
+func latest(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Checks if two sets of rate limits hold the same values
+func limitsEqual(a []RateLimits, b []RateLimits) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Limit != b[i].Limit ||
+			a[i].Counts != b[i].Counts ||
+			a[i].Duration != b[i].Duration ||
+			a[i].RetryAfter != b[i].RetryAfter ||
+			!a[i].LastAt.Equal(b[i].LastAt) ||
+			!a[i].WindowStart.Equal(b[i].WindowStart) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns how long limits stay relevant, which is two of their longest windows or their retry period
+// The window after the current one is still limited, as its first requests may be reserved before any of them is counted
+func limitsTTL(limits []RateLimits) time.Duration {
+	ttl := time.Duration(0)
+
+	for _, limit := range limits {
+		ttl = max(ttl, 2*limit.Duration, limit.RetryAfter)
+	}
+
+	return ttl
+}
+
+// Returns the count and the reset time of the window a request sent at the given time falls into
+// Once the current window has reset, the next one starts with that request and nothing is counted in it yet
+func currentWindow(limit RateLimits, now time.Time) (int, time.Time) {
+	if resetAt := limit.ResetAt(); now.Before(resetAt) {
+		return limit.Counts, resetAt
+	}
+	return 0, now.Add(limit.Duration)
+}
+
+// Calculates how long to wait until every limit, with the safety margin taken off,
+// has room for one more request on top of its current count and the given number of reservations
+func burstWait(limits []RateLimits, reserved int, margin SafetyMargin, now time.Time) time.Duration {
+	return queueSlot(limits, reserved, 0, margin, now).Sub(now)
+}
+
+// Returns when the slot at the given position of a queue opens up in every limit, with the safety margin taken off
+// Slots still free in the current window open right away, later ones are spread evenly over the windows after it,
+// so waiters in a queue get distinct times instead of all waking up when the window resets
+func queueSlot(limits []RateLimits, reserved int, position int, margin SafetyMargin, now time.Time) time.Time {
+	slotAt := now
+
+	for _, limit := range limits {
+		usable := margin.apply(limit.Limit)
+		counts, resetAt := currentWindow(limit, now)
+		free := max(usable-counts-reserved, 0)
+		if position < free {
+			continue
+		}
+
+		// Positions that don't fit into the current window fill the next ones, starting with its reset
+		windows, slot := (position-free)/usable, (position-free)%usable
+		at := resetAt.Add(time.Duration(windows)*limit.Duration + time.Duration(slot)*(limit.Duration/time.Duration(usable)))
+		slotAt = latest(slotAt, at)
+	}
+
+	return slotAt
+}
+
 // Checks if a URL path matches a method path template (e.g., "/lol/summoner/v4/summoners/:puuid")
 func matchesPath(urlPath string, methodPath string) bool {
 	urlSegments := strings.Split(strings.Trim(urlPath, "/"), "/")
@@ -3,6 +3,7 @@ package ratelimiter
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestParseHeader(t *testing.T) {
@@ -210,3 +211,94 @@ func TestUrlHelper(t *testing.T) {
 		})
 	}
 }
+
+func TestReconcileLimits(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	open := []RateLimits{{Limit: 20, Counts: 4, Duration: 10 * time.Second, LastAt: start.Add(2 * time.Second), WindowStart: start}}
+
+	tests := []struct {
+		name        string
+		current     []RateLimits
+		limit       RateLimits
+		expected    time.Time
+		expectCount int
+	}{
+		{
+			name:        "First request of a window",
+			current:     open,
+			limit:       RateLimits{Limit: 20, Counts: 1, Duration: 10 * time.Second, LastAt: start.Add(12 * time.Second)},
+			expected:    start.Add(12 * time.Second),
+			expectCount: 1,
+		},
+		{
+			name:        "Server count is higher",
+			current:     open,
+			limit:       RateLimits{Limit: 20, Counts: 7, Duration: 10 * time.Second, LastAt: start.Add(5 * time.Second)},
+			expected:    start,
+			expectCount: 7,
+		},
+		{
+			name:        "Local count is higher",
+			current:     open,
+			limit:       RateLimits{Limit: 20, Counts: 3, Duration: 10 * time.Second, LastAt: start.Add(5 * time.Second)},
+			expected:    start,
+			expectCount: 5,
+		},
+		{
+			name:        "Late response already counted by a newer one",
+			current:     open,
+			limit:       RateLimits{Limit: 20, Counts: 3, Duration: 10 * time.Second, LastAt: start.Add(time.Second)},
+			expected:    start,
+			expectCount: 4,
+		},
+		{
+			name:        "Late response from before the window",
+			current:     open,
+			limit:       RateLimits{Limit: 20, Counts: 1, Duration: 10 * time.Second, LastAt: start.Add(-time.Second)},
+			expected:    start,
+			expectCount: 4,
+		},
+		{
+			name:        "Count dropped back to 1 within the window",
+			current:     open,
+			limit:       RateLimits{Limit: 20, Counts: 1, Duration: 10 * time.Second, LastAt: start.Add(4 * time.Second)},
+			expected:    start.Add(4 * time.Second),
+			expectCount: 1,
+		},
+		{
+			name:        "Window already reset",
+			current:     open,
+			limit:       RateLimits{Limit: 20, Counts: 3, Duration: 10 * time.Second, LastAt: start.Add(11 * time.Second)},
+			expected:    start.Add(11 * time.Second),
+			expectCount: 3,
+		},
+		{
+			name:        "Different window",
+			current:     open,
+			limit:       RateLimits{Limit: 100, Counts: 7, Duration: 120 * time.Second, LastAt: start.Add(5 * time.Second)},
+			expected:    start.Add(5 * time.Second),
+			expectCount: 7,
+		},
+		{
+			name:        "Nothing known yet",
+			limit:       RateLimits{Limit: 20, Counts: 7, Duration: 10 * time.Second, LastAt: start},
+			expected:    start,
+			expectCount: 7,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := reconcileLimits(tt.current, []RateLimits{tt.limit})
+			if !merged[0].WindowStart.Equal(tt.expected) {
+				t.Errorf("Expected the window to start at %v, got %v", tt.expected, merged[0].WindowStart)
+			}
+			if !merged[0].ResetAt().Equal(tt.expected.Add(tt.limit.Duration)) {
+				t.Errorf("Expected the window to reset at %v, got %v", tt.expected.Add(tt.limit.Duration), merged[0].ResetAt())
+			}
+			if merged[0].Counts != tt.expectCount {
+				t.Errorf("Expected a count of %d, got %d", tt.expectCount, merged[0].Counts)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package ratelimiter
+
+import "time"
+
+// SetLeaseDuration sets how long new reservations are held before they are reclaimed
+// Use something longer than the request timeout, so only reservations that will never be finished expire
+func (rl *RateLimiter) SetLeaseDuration(duration time.Duration) {
+	rl.leaseDuration.Store(int64(duration))
+}
+
+// OnLeaseReclaimed sets a callback run whenever expired reservations are reclaimed from a bucket
+// n is the number of reservations reclaimed, pass nil to remove the callback
+func (rl *RateLimiter) OnLeaseReclaimed(callback func(key BucketKey, n int)) {
+	if callback == nil {
+		rl.leaseReclaimed.Store(nil)
+		return
+	}
+	rl.leaseReclaimed.Store(&callback)
+}
+
+// ReclaimedLeases returns the total number of expired reservations reclaimed so far
+func (rl *RateLimiter) ReclaimedLeases() uint64 {
+	return rl.reclaimedLeases.Load()
+}
+
+// Creates a lease for a new reservation
+func (rl *RateLimiter) newLease() Lease {
+	return newLease(rl.now().Add(time.Duration(rl.leaseDuration.Load())))
+}
+
+// Frees the expired leases of the given buckets, reporting them to the callback
+func (rl *RateLimiter) reclaim(keys ...BucketKey) {
+	now := rl.now()
+	for _, key := range keys {
+		if n := rl.cache.ReclaimLeases(key, now); n > 0 {
+			rl.leasesReclaimed(key, n)
+		}
+	}
+}
+
+// Counts the leases reclaimed from a bucket and reports them to the callback
+func (rl *RateLimiter) leasesReclaimed(key BucketKey, n int) {
+	rl.reclaimedLeases.Add(uint64(n))
+	if callback := rl.leaseReclaimed.Load(); callback != nil {
+		(*callback)(key, n)
+	}
+}
+
+// Releases a single lease from the buckets of a request
+func (rl *RateLimiter) releaseLease(details *RateLimitDetails, id string) {
+	for _, key := range rl.bucketPath(details) {
+		rl.cache.RemoveLease(key, id)
+	}
+}
+
+// Releases the n leases expiring soonest from the buckets of a request
+func (rl *RateLimiter) releaseN(details *RateLimitDetails, n int) {
+	for _, key := range rl.bucketPath(details) {
+		rl.cache.RemoveLeasesN(key, n)
+	}
+}
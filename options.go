@@ -0,0 +1,170 @@
+package ratelimiter
+
+import (
+	"math"
+	"time"
+)
+
+// Option configures a RateLimiter, see NewRateLimiter
+type Option func(*RateLimiter)
+
+// SafetyMargin is headroom left unused in every window, so requests at the edge of a window don't get a 429
+// With both set, the larger headroom is used. A limit always keeps at least one usable request
+// GetWaitFor, TryReserve, Wait and the Transport all take it off the limits, Reserve doesn't check the limits and ignores it
+type SafetyMargin struct {
+	// Percentage of each limit to leave unused, rounded down
+	Percent float64
+	// Number of requests to leave unused
+	Count int
+}
+
+// Returns the limit with the headroom taken off
+func (m SafetyMargin) apply(limit int) int {
+	headroom := max(int(math.Floor(float64(limit)*m.Percent/100)), m.Count)
+	return max(limit-headroom, 1)
+}
+
+// Hooks are callbacks for limiter events, any of them may be nil
+// They are called synchronously, so they should return quickly
+type Hooks struct {
+	// Called when a request has to wait before it may be sent
+	OnWait func(details RateLimitDetails, wait time.Duration)
+	// Called when a 429 blocks a bucket
+	OnBlocked func(key BucketKey, until time.Time)
+	// Called after the limits of a bucket were updated from a response
+	OnLimitsUpdated func(key BucketKey, limits []RateLimits)
+	// Called when expired reservations are reclaimed from a bucket, see OnLeaseReclaimed
+	OnLeaseReclaimed func(key BucketKey, n int)
+	// Called with errors that have no caller to return them to, like a failed periodic snapshot
+	OnError func(err error)
+}
+
+// WithDefaultLimits sets the limits assumed for application and method buckets until a response reports the real ones
+// Only Limit and Duration are used, either may be nil to assume no limits for that scope
+func WithDefaultLimits(app []RateLimits, method []RateLimits) Option {
+	return func(rl *RateLimiter) {
+		rl.defaultLimits = map[LimitType][]RateLimits{
+			LIMIT_TYPE_APPLICATION: app,
+			LIMIT_TYPE_METHOD:      method,
+		}
+	}
+}
+
+// WithDefaultStrategy sets the strategy used when an empty one is passed, LIMIT_STRATEGY_SPREAD unless set
+// It must be a built-in or registered strategy, see RegisterStrategy
+func WithDefaultStrategy(strategy LimitStrategy) Option {
+	return func(rl *RateLimiter) {
+		rl.defaultStrategy = strategy
+	}
+}
+
+// WithSafetyMargin sets the headroom left unused in every window of every scope, including the levels added with WithBucketTree
+// Margins set for a scope with WithScopeSafetyMargin win over it, whatever the order of the options
+func WithSafetyMargin(margin SafetyMargin) Option {
+	return func(rl *RateLimiter) {
+		rl.safetyMargin = margin
+	}
+}
+
+// WithScopeSafetyMargin sets the headroom left unused in every window of a single scope, instead of the one set with WithSafetyMargin
+// e.g. WithScopeSafetyMargin(LIMIT_TYPE_APPLICATION, SafetyMargin{Percent: 10}) only applies to application limits
+func WithScopeSafetyMargin(scope LimitType, margin SafetyMargin) Option {
+	return func(rl *RateLimiter) {
+		if rl.safetyMargins == nil {
+			rl.safetyMargins = map[LimitType]SafetyMargin{}
+		}
+		rl.safetyMargins[scope] = margin
+	}
+}
+
+// Returns the safety margin of a scope, the one set for it with WithScopeSafetyMargin or else the one set with WithSafetyMargin
+func (rl *RateLimiter) scopeSafetyMargin(scope LimitType) SafetyMargin {
+	if margin, exists := rl.safetyMargins[scope]; exists {
+		return margin
+	}
+	return rl.safetyMargin
+}
+
+// WithPriorityShare sets the percentage of every limit that requests of the given priority leave unused, for requests of higher priorities
+// e.g. WithPriorityShare(PRIORITY_LOW, 20) keeps a fifth of every window free for normal and high priority requests
+// The share is added to the percent of the safety margin
+func WithPriorityShare(priority Priority, percent float64) Option {
+	return func(rl *RateLimiter) {
+		if rl.priorityShares == nil {
+			rl.priorityShares = map[Priority]float64{}
+		}
+		rl.priorityShares[priority] = percent
+	}
+}
+
+// WithTenant sets up a tenant with its share of the application limits of every platform, see RateLimiter.Tenant
+// e.g. three tenants guaranteed 0.4, 0.3 and 0.3 split the limits 40/30/30, while a Max of 1 lets each borrow what the others leave idle
+// Requests without a tenant only get what is left idle as well
+// Requests beyond a guaranteed share never use the guaranteed shares other tenants haven't used yet in a window, even when they arrive first
+func WithTenant(name string, quota TenantQuota) Option {
+	return func(rl *RateLimiter) {
+		if quota.Max <= 0 {
+			quota.Max = 1
+		}
+		if rl.tenants == nil {
+			rl.tenants = map[string]*tenantAccount{}
+		}
+		rl.tenants[name] = &tenantAccount{quota: quota}
+	}
+}
+
+// WithClock sets the clock used by the limiter instead of the system time, for timestamps as well as for sleeping in Wait
+// Give the store the same clock, see NewStoreWithClock and RedisOptions.Clock
+func WithClock(clock Clock) Option {
+	return func(rl *RateLimiter) {
+		rl.clock = clock
+	}
+}
+
+// WithHooks sets callbacks for limiter events
+func WithHooks(hooks Hooks) Option {
+	return func(rl *RateLimiter) {
+		rl.hooks = hooks
+		rl.OnLeaseReclaimed(hooks.OnLeaseReclaimed)
+	}
+}
+
+// WithLeaseDuration sets how long reservations are held before they are reclaimed, see SetLeaseDuration
+func WithLeaseDuration(duration time.Duration) Option {
+	return func(rl *RateLimiter) {
+		rl.SetLeaseDuration(duration)
+	}
+}
+
+// Returns the current time according to the clock of the limiter
+func (rl *RateLimiter) now() time.Time {
+	return rl.clock.Now()
+}
+
+// Reports a wait to the OnWait hook, if there is one
+func (rl *RateLimiter) notifyWait(details *RateLimitDetails, wait time.Duration) {
+	if wait > 0 && rl.hooks.OnWait != nil {
+		rl.hooks.OnWait(*details, wait)
+	}
+}
+
+// Reports an error to the OnError hook, if there is one
+func (rl *RateLimiter) notifyError(err error) {
+	if err != nil && rl.hooks.OnError != nil {
+		rl.hooks.OnError(err)
+	}
+}
+
+// Installs the default limits on the buckets of a request that don't know their limits yet
+// Their windows start now, and are replaced as soon as a response reports the real limits
+func (rl *RateLimiter) seedDefaultLimits(details *RateLimitDetails) {
+	now := rl.now()
+	for scope, defaults := range rl.defaultLimits {
+		if len(defaults) > 0 {
+			rl.seedLimits(details.bucketKey(scope), defaults, now)
+		}
+	}
+
+	rl.seedLevelLimits(details)
+	rl.seedTenantLimits(details)
+}
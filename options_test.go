@@ -0,0 +1,151 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSafetyMargin(t *testing.T) {
+	tests := []struct {
+		name     string
+		margin   SafetyMargin
+		limit    int
+		expected int
+	}{
+		{name: "No margin", limit: 20, expected: 20},
+		{name: "Percent", margin: SafetyMargin{Percent: 10}, limit: 20, expected: 18},
+		{name: "Percent rounds down", margin: SafetyMargin{Percent: 10}, limit: 15, expected: 14},
+		{name: "Count", margin: SafetyMargin{Count: 3}, limit: 20, expected: 17},
+		{name: "Larger of both", margin: SafetyMargin{Percent: 10, Count: 1}, limit: 100, expected: 90},
+		{name: "Keeps one request", margin: SafetyMargin{Count: 5}, limit: 3, expected: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := tt.margin.apply(tt.limit); result != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestOptions(t *testing.T) {
+	now := time.Date(2025, 7, 22, 12, 0, 0, 0, time.UTC)
+	limits := []RateLimits{{Limit: 10, Counts: 8, Duration: time.Minute, LastAt: now, WindowStart: now.Add(-30 * time.Second)}}
+	clock := NewFakeClock(now)
+
+	tests := []struct {
+		name     string
+		options  []Option
+		strategy LimitStrategy
+		expected time.Duration
+	}{
+		{name: "Defaults", options: []Option{WithClock(clock)}, expected: 15 * time.Second},
+		{name: "Default strategy", options: []Option{WithClock(clock), WithDefaultStrategy(LIMIT_STRATEGY_BURST)}, expected: 0},
+		{name: "Explicit strategy wins", options: []Option{WithClock(clock), WithDefaultStrategy(LIMIT_STRATEGY_BURST)}, strategy: LIMIT_STRATEGY_SPREAD, expected: 15 * time.Second},
+		{name: "Safety margin", options: []Option{WithClock(clock), WithSafetyMargin(SafetyMargin{Count: 2})}, strategy: LIMIT_STRATEGY_BURST, expected: 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := NewRateLimiter(NewStoreWithClock(clock), tt.options...)
+			if err := rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, limits); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			wait, err := rl.GetWaitFor(testUrl, "GET", tt.strategy)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if wait != tt.expected {
+				t.Errorf("Expected to wait %v, got %v", tt.expected, wait)
+			}
+		})
+	}
+}
+
+func TestDefaultLimits(t *testing.T) {
+	store := NewStore()
+	rl := NewRateLimiter(store, WithDefaultLimits(nil, []RateLimits{{Limit: 2, Duration: time.Minute}}))
+
+	for i := 0; i < 2; i++ {
+		if reservation, _, _ := rl.TryReserve(testUrl, "GET"); reservation == nil {
+			t.Fatalf("Expected reservation %d to fit the default limits", i+1)
+		}
+	}
+	if reservation, wait, _ := rl.TryReserve(testUrl, "GET"); reservation != nil || wait <= 0 {
+		t.Errorf("Expected the default method limit to be enforced, got %v", wait)
+	}
+
+	if state, _ := store.Get(testAppKey); len(state.Limits) != 0 {
+		t.Errorf("Expected no default application limits, got %v", state.Limits)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var waited time.Duration
+	var blocked, updated BucketKey
+	rl := NewRateLimiter(NewStore(), WithHooks(Hooks{
+		OnWait:          func(details RateLimitDetails, wait time.Duration) { waited = wait },
+		OnBlocked:       func(key BucketKey, until time.Time) { blocked = key },
+		OnLimitsUpdated: func(key BucketKey, limits []RateLimits) { updated = key },
+	}))
+
+	headers := http.Header{}
+	headers.Set("X-Method-Rate-Limit", "1:60")
+	headers.Set("X-Method-Rate-Limit-Count", "1:60")
+	headers.Set("Retry-After", "30")
+	headers.Set("X-Rate-Limit-Type", "method")
+	if err := rl.UpdateFromHeaders(testUrl, "GET", headers); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := rl.GetWaitFor(testUrl, "GET", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if waited <= 0 || blocked != testMethodKey || updated != testMethodKey {
+		t.Errorf("Expected every hook to fire for the method bucket, got %v, %v and %v", waited, blocked, updated)
+	}
+}
+
+func TestScopeSafetyMargin(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       []Option
+		expectReserve bool
+	}{
+		{name: "No margin", expectReserve: true},
+		{name: "Application margin", options: []Option{WithScopeSafetyMargin(LIMIT_TYPE_APPLICATION, SafetyMargin{Count: 3})}},
+		{name: "Method margin", options: []Option{WithScopeSafetyMargin(LIMIT_TYPE_METHOD, SafetyMargin{Count: 3})}, expectReserve: true},
+		{name: "Margin for every scope", options: []Option{WithSafetyMargin(SafetyMargin{Percent: 30})}},
+		{name: "Scope margin overrides", options: []Option{WithSafetyMargin(SafetyMargin{Percent: 30}), WithScopeSafetyMargin(LIMIT_TYPE_APPLICATION, SafetyMargin{})}, expectReserve: true},
+		{name: "Scope margin set first overrides", options: []Option{WithScopeSafetyMargin(LIMIT_TYPE_APPLICATION, SafetyMargin{}), WithSafetyMargin(SafetyMargin{Percent: 30})}, expectReserve: true},
+	}
+
+	now := time.Now()
+	appLimits := []RateLimits{{Limit: 10, Counts: 7, Duration: time.Minute, LastAt: now, WindowStart: now}}
+	methodLimits := []RateLimits{{Limit: 100, Counts: 7, Duration: time.Minute, LastAt: now, WindowStart: now}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := NewRateLimiter(NewStore(), tt.options...)
+			rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, appLimits)
+			rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_METHOD, methodLimits)
+
+			reservation, wait, err := rl.TryReserve(testUrl, "GET")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if (reservation != nil) != tt.expectReserve {
+				t.Errorf("Expected reserved to be %v, got %v", tt.expectReserve, reservation != nil)
+			}
+
+			burstWait, _ := rl.GetWaitFor(testUrl, "GET", LIMIT_STRATEGY_BURST)
+			if tt.expectReserve == (wait > 0 || burstWait > 0) {
+				t.Errorf("Expected GetWaitFor to agree with TryReserve, got %v and %v", wait, burstWait)
+			}
+		})
+	}
+}
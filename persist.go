@@ -0,0 +1,193 @@
+package ratelimiter
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Snapshot of the limiter state, as written to disk
+type snapshot struct {
+	SavedAt time.Time        `json:"savedAt"`
+	Buckets []snapshotBucket `json:"buckets"`
+}
+
+// State of a single bucket in a snapshot
+type snapshotBucket struct {
+	Key          BucketKey    `json:"key"`
+	Limits       []RateLimits `json:"limits"`
+	Leases       []Lease      `json:"leases,omitempty"`
+	BlockedUntil time.Time    `json:"blockedUntil,omitzero"`
+}
+
+// SaveSnapshot writes the limits and reservations of every bucket seen so far as JSON
+// Buckets the store no longer has are forgotten along the way
+func (rl *RateLimiter) SaveSnapshot(w io.Writer) error {
+	rl.prune()
+	state := snapshot{SavedAt: rl.now(), Buckets: []snapshotBucket{}}
+
+	rl.buckets.Range(func(keyRaw, _ any) bool {
+		key := keyRaw.(BucketKey)
+		if bucketState, exists := rl.cache.Get(key); exists {
+			state.Buckets = append(state.Buckets, snapshotBucket{
+				Key:          key,
+				Limits:       bucketState.Limits,
+				Leases:       bucketState.Leases,
+				BlockedUntil: bucketState.BlockedUntil,
+			})
+		}
+		return true
+	})
+
+	return json.NewEncoder(w).Encode(state)
+}
+
+// LoadSnapshot restores the state written by SaveSnapshot
+// Limits whose window has already elapsed are discarded, along with the reservations of their bucket unless it is still blocked
+// Reservations whose lease has expired are discarded as well
+// The snapshot is merged into the store rather than replacing it, so with a shared Store the newer counts, reservations and blocks
+// of other processes are kept
+func (rl *RateLimiter) LoadSnapshot(r io.Reader) error {
+	var state snapshot
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return errors.New("invalid snapshot: " + err.Error())
+	}
+
+	now := rl.now()
+	for _, bucket := range state.Buckets {
+		var limits []RateLimits
+		for _, limit := range bucket.Limits {
+			if limit.ResetAt().After(now) || limit.LastAt.Add(limit.RetryAfter).After(now) {
+				limits = append(limits, limit)
+			}
+		}
+
+		if len(limits) == 0 && !bucket.BlockedUntil.After(now) {
+			continue
+		}
+
+		rl.track(bucket.Key)
+		rl.updateLimits(bucket.Key, func(current []RateLimits) []RateLimits { return restoredLimits(current, limits) })
+		if bucket.BlockedUntil.After(now) {
+			rl.cache.Block(bucket.Key, bucket.BlockedUntil)
+		}
+
+		current, _ := rl.cache.Get(bucket.Key)
+		for _, lease := range bucket.Leases {
+			held := slices.ContainsFunc(current.Leases, func(l Lease) bool { return l.ID == lease.ID })
+			if !held && !lease.expired(now) {
+				rl.cache.AddLease(bucket.Key, lease)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the current limits with the restored ones merged in
+// A restored limit replaces the current one of the same duration if its window is newer, or if it is the same window with a higher count
+func restoredLimits(current []RateLimits, restored []RateLimits) []RateLimits {
+	merged := slices.Clone(current)
+	for _, limit := range restored {
+		index := slices.IndexFunc(merged, func(l RateLimits) bool { return l.Duration == limit.Duration })
+		switch {
+		case index < 0:
+			merged = append(merged, limit)
+		case merged[index].ResetAt().Before(limit.ResetAt()),
+			merged[index].ResetAt().Equal(limit.ResetAt()) && merged[index].Counts < limit.Counts:
+			merged[index] = limit
+		}
+	}
+	return merged
+}
+
+// SaveSnapshotFile writes a snapshot to the given path
+// The file is replaced atomically, so a crash while saving never leaves a partial snapshot behind
+func (rl *RateLimiter) SaveSnapshotFile(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := rl.SaveSnapshot(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// LoadSnapshotFile restores a snapshot from the given path
+// A missing file is not an error, since there is nothing to restore on the first start
+func (rl *RateLimiter) LoadSnapshotFile(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return rl.LoadSnapshot(file)
+}
+
+// StartSnapshots restores the snapshot at path, then saves a new one every interval
+// Errors saving them are reported to the OnError hook, see WithHooks
+// Call Close on shutdown to stop saving and write a final snapshot
+func (rl *RateLimiter) StartSnapshots(path string, interval time.Duration) error {
+	rl.snapshotMu.Lock()
+	defer rl.snapshotMu.Unlock()
+	if rl.snapshotStop != nil {
+		return errors.New("snapshots already started for " + rl.snapshotPath)
+	}
+
+	if err := rl.LoadSnapshotFile(path); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	rl.snapshotPath, rl.snapshotStop, rl.snapshotDone = path, stop, done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rl.notifyError(rl.SaveSnapshotFile(path))
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops saving snapshots, if they were started, and writes a final one
+func (rl *RateLimiter) Close() error {
+	rl.snapshotMu.Lock()
+	defer rl.snapshotMu.Unlock()
+	if rl.snapshotStop == nil {
+		return nil
+	}
+
+	close(rl.snapshotStop)
+	<-rl.snapshotDone
+	rl.snapshotStop, rl.snapshotDone = nil, nil
+
+	return rl.SaveSnapshotFile(rl.snapshotPath)
+}
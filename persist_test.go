@@ -0,0 +1,120 @@
+package ratelimiter
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	rl := NewRateLimiter(NewStore())
+	if _, err := rl.Reserve(testUrl, "GET"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 100, Counts: 95, Duration: 120 * time.Second, LastAt: time.Now()},
+		{Limit: 20, Counts: 3, Duration: time.Second, LastAt: time.Now().Add(-2 * time.Second)},
+	})
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_METHOD, []RateLimits{
+		{Limit: 10, Counts: 10, Duration: 10 * time.Second, LastAt: time.Now().Add(-time.Minute)},
+	})
+
+	if err := rl.StartSnapshots(path, time.Hour); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := rl.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	store := NewStore()
+	restored := NewRateLimiter(store)
+	if err := restored.LoadSnapshotFile(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	state, _ := store.Get(testAppKey)
+	if len(state.Limits) != 1 || state.Limits[0].Counts != 95 {
+		t.Errorf("Expected only the 120s window to be restored, got %v", state.Limits)
+	}
+
+	if state.Reserved() != 1 {
+		t.Errorf("Expected 1 reservation to be restored, got %d", state.Reserved())
+	}
+
+	if store.Has(testMethodKey) {
+		t.Errorf("Expected the elapsed method bucket to be discarded")
+	}
+
+	if err := NewRateLimiter(NewStore()).LoadSnapshotFile(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("Expected a missing snapshot to be ignored, got %v", err)
+	}
+}
+
+func TestSnapshotErrorsAreReported(t *testing.T) {
+	// The directory doesn't exist, so there is nothing to restore but saving fails
+	path := filepath.Join(t.TempDir(), "missing", "state.json")
+
+	errs := make(chan error, 1)
+	rl := NewRateLimiter(NewStore(), WithHooks(Hooks{OnError: func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}}))
+	if err := rl.StartSnapshots(path, 5*time.Millisecond); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer rl.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected the failed save to be reported, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the failed save to be reported")
+	}
+}
+
+func TestSnapshotMergesIntoSharedStore(t *testing.T) {
+	clock := NewFakeClock(time.Date(2025, 7, 22, 12, 0, 0, 0, time.UTC))
+	start := clock.Now()
+
+	// The restarting process saved its snapshot at 50 of 100, with one reservation held
+	rl := NewRateLimiter(NewStoreWithClock(clock), WithClock(clock))
+	rl.Reserve(testUrl, "GET")
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 100, Counts: 50, Duration: 2 * time.Minute, LastAt: start, WindowStart: start},
+		{Limit: 20, Counts: 5, Duration: 10 * time.Second, LastAt: start, WindowStart: start},
+	})
+	var buf bytes.Buffer
+	if err := rl.SaveSnapshot(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Meanwhile the other processes sharing the store went on to 80 of 100 and a new 10s window, and hold a reservation
+	clock.Advance(15 * time.Second)
+	store := NewStoreWithClock(clock)
+	store.Set(testAppKey, BucketState{Limits: []RateLimits{
+		{Limit: 100, Counts: 80, Duration: 2 * time.Minute, LastAt: clock.Now(), WindowStart: start},
+		{Limit: 20, Counts: 1, Duration: 10 * time.Second, LastAt: clock.Now(), WindowStart: clock.Now()},
+	}, Leases: []Lease{newLease(clock.Now().Add(time.Minute))}}, 0)
+
+	restored := NewRateLimiter(store, WithClock(clock))
+	if err := restored.LoadSnapshot(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	state, _ := store.Get(testAppKey)
+	if len(state.Limits) != 2 || state.Limits[0].Counts != 80 || state.Limits[1].Counts != 1 {
+		t.Errorf("Expected the newer and higher counts of the store to be kept, got %v", state.Limits)
+	}
+	if state.Reserved() != 2 {
+		t.Errorf("Expected the restored reservation to be added to the one held, got %d", state.Reserved())
+	}
+}
@@ -0,0 +1,57 @@
+package ratelimiter
+
+import (
+	"context"
+	"time"
+)
+
+// Returns the rank of a request in the queues, requests of higher ranks go first
+// Requests within the guaranteed share of their tenant go ahead of other requests of the same priority
+func queueRank(priority Priority, guaranteed bool) int {
+	rank := 2 * int(priority)
+	if guaranteed {
+		rank++
+	}
+	return rank
+}
+
+// Returns the checks for the buckets of a request of the given priority, see queueRank
+// Each bucket leaves a slot for every waiting request of a higher rank, and the share set with WithPriorityShare on top of its margin
+// Requests outside of a guaranteed share leave the unused guaranteed shares of the tenants in the application bucket as well
+func (rl *RateLimiter) priorityChecks(details *RateLimitDetails, priority Priority, guaranteed bool) []BucketCheck {
+	checks := rl.bucketChecks(details)
+	rank := queueRank(priority, guaranteed)
+	appKey := details.bucketKey(LIMIT_TYPE_APPLICATION)
+	for i := range checks {
+		checks[i].Margin.Percent += rl.priorityShares[priority]
+		if queue, exists := rl.queues.Load(checks[i].Key); exists {
+			checks[i].Held = queue.(*waitQueue).above(rank)
+		}
+		if !guaranteed && len(rl.tenants) > 0 && checks[i].Key == appKey {
+			checks[i].HeldInWindow = rl.unusedGuarantees(details, rl.now())
+		}
+	}
+	return checks
+}
+
+// WaitPriority is like Wait, but for a request of the given priority
+// While it waits, requests of lower priorities in this process leave a slot free for it, so it gets the next free slot ahead of them
+func (rl *RateLimiter) WaitPriority(ctx context.Context, url string, method string, strategy LimitStrategy, priority Priority) (*Reservation, error) {
+	details, err := urlHelper(url, method)
+	if err != nil {
+		return nil, err
+	}
+
+	return rl.wait(ctx, details, strategy, priority)
+}
+
+// TryReservePriority is like TryReserve, but for a request of the given priority
+// It only reserves if a slot is free after leaving one for every waiting request of a higher priority
+func (rl *RateLimiter) TryReservePriority(url string, method string, priority Priority) (*Reservation, time.Duration, error) {
+	details, err := urlHelper(url, method)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return rl.tryReserve(details, priority)
+}
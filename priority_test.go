@@ -0,0 +1,50 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriorities(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       []Option
+		waiting       []Priority
+		priority      Priority
+		expectReserve bool
+	}{
+		{name: "Free slot", priority: PRIORITY_LOW, expectReserve: true},
+		{name: "Held for a higher waiter", waiting: []Priority{PRIORITY_HIGH}, priority: PRIORITY_LOW},
+		{name: "Not held for an equal waiter", waiting: []Priority{PRIORITY_LOW}, priority: PRIORITY_LOW, expectReserve: true},
+		{name: "Not held for a lower waiter", waiting: []Priority{PRIORITY_LOW, PRIORITY_LOW}, priority: PRIORITY_HIGH, expectReserve: true},
+		{name: "Held share", options: []Option{WithPriorityShare(PRIORITY_LOW, 30)}, priority: PRIORITY_LOW},
+		{name: "Share of another priority", options: []Option{WithPriorityShare(PRIORITY_LOW, 30)}, priority: PRIORITY_NORMAL, expectReserve: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewFakeClock(time.Now())
+			rl := NewRateLimiter(NewStoreWithClock(clock), append(tt.options, WithClock(clock))...)
+			rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+				{Limit: 10, Counts: 9, Duration: time.Minute, LastAt: clock.Now(), WindowStart: clock.Now()},
+			})
+
+			details, _ := urlHelper(testUrl, "GET")
+			for _, priority := range tt.waiting {
+				_, leave := rl.joinQueues(details, queueRank(priority, false))
+				defer leave()
+			}
+
+			reservation, wait, err := rl.TryReservePriority(testUrl, "GET", tt.priority)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if (reservation != nil) != tt.expectReserve {
+				t.Errorf("Expected reserved to be %v, got %v", tt.expectReserve, reservation != nil)
+			}
+			if reservation == nil && wait != time.Minute {
+				t.Errorf("Expected to wait for the window to reset, got %v", wait)
+			}
+		})
+	}
+}
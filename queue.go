@@ -0,0 +1,124 @@
+package ratelimiter
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// A request waiting for a slot in the queues of its buckets
+type queueEntry struct {
+	rank int
+	seq  uint64
+}
+
+// Requests of this process waiting for slots in a bucket, ordered by rank and then by arrival
+type waitQueue struct {
+	mu      sync.Mutex
+	entries []*queueEntry
+	// Set once the queue emptied and was dropped from the limiter, entries then have to join a new one
+	dropped bool
+}
+
+// Inserts an entry behind every entry of the same or a higher rank, returns false if the queue was dropped
+func (q *waitQueue) add(entry *queueEntry) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.dropped {
+		return false
+	}
+	index := slices.IndexFunc(q.entries, func(e *queueEntry) bool { return e.rank < entry.rank })
+	if index < 0 {
+		index = len(q.entries)
+	}
+	q.entries = slices.Insert(q.entries, index, entry)
+	return true
+}
+
+// Removes an entry from the queue, returns true if that left it empty and it was dropped
+func (q *waitQueue) remove(entry *queueEntry) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.entries = slices.DeleteFunc(q.entries, func(e *queueEntry) bool { return e == entry })
+	q.dropped = len(q.entries) == 0
+	return q.dropped
+}
+
+// Returns the number of entries ahead of the given one
+func (q *waitQueue) ahead(entry *queueEntry) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return max(slices.Index(q.entries, entry), 0)
+}
+
+// Returns the number of entries of a rank above the given one
+func (q *waitQueue) above(rank int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count := 0
+	for _, e := range q.entries {
+		if e.rank <= rank {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// Returns the queue of a bucket, creating it on first use
+// It is dropped again once its last entry leaves, see joinQueues
+func (rl *RateLimiter) queue(key BucketKey) *waitQueue {
+	queue, _ := rl.queues.LoadOrStore(key, &waitQueue{})
+	return queue.(*waitQueue)
+}
+
+// Adds a request of the given rank to the queues of its buckets, see queueRank
+// Returns its entry along with a function removing it again, which is safe to call more than once
+func (rl *RateLimiter) joinQueues(details *RateLimitDetails, rank int) (*queueEntry, func()) {
+	entry := &queueEntry{rank: rank, seq: rl.queueSeq.Add(1)}
+	keys := rl.bucketPath(details)
+	queues := make([]*waitQueue, len(keys))
+	for i, key := range keys {
+		queues[i] = rl.queue(key)
+		for !queues[i].add(entry) {
+			queues[i] = rl.queue(key)
+		}
+	}
+
+	return entry, sync.OnceFunc(func() {
+		for i, queue := range queues {
+			// Empty queues are dropped, so buckets nobody waits for don't keep one around
+			if queue.remove(entry) {
+				rl.queues.CompareAndDelete(keys[i], queue)
+			}
+		}
+	})
+}
+
+// Returns when the entry of a request is scheduled to be sent
+// Every entry gets the slot after those of the entries ahead of it in the queues of its buckets
+func (rl *RateLimiter) scheduledAt(details *RateLimitDetails, entry *queueEntry, now time.Time) time.Time {
+	sendAt := now
+	for _, check := range rl.bucketChecks(details) {
+		state, _ := rl.cache.Get(check.Key)
+		position := rl.queue(check.Key).ahead(entry)
+		sendAt = latest(sendAt, queueSlot(state.Limits, state.Reserved(), position, check.Margin, now))
+	}
+	return sendAt
+}
+
+// Returns when a request joining the queues of its buckets now would be scheduled to be sent, without joining them
+// Used by GetWaitFor, which only peeks at the queues so that calling it never takes a slot
+func (rl *RateLimiter) nextSlot(details *RateLimitDetails, now time.Time) time.Time {
+	rank := queueRank(PRIORITY_NORMAL, rl.withinGuarantee(details, now))
+	sendAt := now
+	for _, check := range rl.bucketChecks(details) {
+		state, _ := rl.cache.Get(check.Key)
+		position := 0
+		if queue, exists := rl.queues.Load(check.Key); exists {
+			position = queue.(*waitQueue).above(rank - 1)
+		}
+		sendAt = latest(sendAt, queueSlot(state.Limits, state.Reserved(), position, check.Margin, now))
+	}
+	return sendAt
+}
@@ -0,0 +1,115 @@
+package ratelimiter
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueSlot(t *testing.T) {
+	now := time.Date(2025, 7, 22, 12, 0, 0, 0, time.UTC)
+	full := []RateLimits{{Limit: 4, Counts: 3, Duration: time.Minute, LastAt: now, WindowStart: now.Add(-30 * time.Second)}}
+	reset := now.Add(30 * time.Second)
+
+	tests := []struct {
+		name     string
+		limits   []RateLimits
+		reserved int
+		position int
+		expected time.Time
+	}{
+		{name: "No limits", position: 10, expected: now},
+		{name: "Free slot", limits: full, expected: now},
+		{name: "Taken by a reservation", limits: full, reserved: 1, expected: reset},
+		{name: "Next window", limits: full, position: 1, expected: reset},
+		{name: "Spread over the next window", limits: full, position: 3, expected: reset.Add(30 * time.Second)},
+		{name: "Window after next", limits: full, position: 5, expected: reset.Add(time.Minute)},
+		{name: "Reset window", limits: []RateLimits{{Limit: 2, Counts: 2, Duration: time.Minute, WindowStart: now.Add(-time.Hour)}}, reserved: 2, expected: now.Add(time.Minute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := queueSlot(tt.limits, tt.reserved, tt.position, SafetyMargin{}, now); !result.Equal(tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestWaitersAreStaggered(t *testing.T) {
+	clock := NewFakeClock(time.Date(2025, 7, 22, 12, 0, 0, 0, time.UTC))
+	start := clock.Now()
+
+	var mu sync.Mutex
+	var waits []time.Duration
+	rl := NewRateLimiter(NewStoreWithClock(clock), WithClock(clock), WithHooks(Hooks{OnWait: func(_ RateLimitDetails, wait time.Duration) {
+		mu.Lock()
+		waits = append(waits, wait)
+		mu.Unlock()
+	}}))
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 2, Counts: 2, Duration: 10 * time.Second, LastAt: start, WindowStart: start},
+	})
+
+	admitted := make(chan time.Duration, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			if _, err := rl.Wait(context.Background(), testUrl, "GET", LIMIT_STRATEGY_BURST); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			admitted <- clock.Now().Sub(start)
+		}()
+	}
+
+	// Every waiter sleeps until its own slot, two per window
+	clock.BlockUntilTimers(4)
+	mu.Lock()
+	slices.Sort(waits)
+	expected := []time.Duration{10 * time.Second, 15 * time.Second, 20 * time.Second, 25 * time.Second}
+	if !slices.Equal(waits, expected) {
+		t.Errorf("Expected waits of %v, got %v", expected, waits)
+	}
+	mu.Unlock()
+
+	for _, at := range expected {
+		clock.Advance(at - clock.Now().Sub(start))
+		if sentAt := <-admitted; sentAt != at {
+			t.Errorf("Expected a waiter to be admitted at %v, got %v", at, sentAt)
+		}
+	}
+}
+
+func TestGetWaitForTakesNoSlot(t *testing.T) {
+	clock := NewFakeClock(time.Date(2025, 7, 22, 12, 0, 0, 0, time.UTC))
+	rl := NewRateLimiter(NewStoreWithClock(clock), WithClock(clock))
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 2, Counts: 0, Duration: 10 * time.Second, LastAt: clock.Now(), WindowStart: clock.Now()},
+	})
+
+	// GetWaitFor, Reserve and GetWaitFor again only count the reserved request
+	if wait, _ := rl.GetWaitFor(testUrl, "GET", LIMIT_STRATEGY_BURST); wait != 0 {
+		t.Errorf("Expected no wait, got %v", wait)
+	}
+	rl.Reserve(testUrl, "GET")
+	if wait, _ := rl.GetWaitFor(testUrl, "GET", LIMIT_STRATEGY_BURST); wait != 0 {
+		t.Errorf("Expected the second slot to still be free, got %v", wait)
+	}
+
+	// Polling a full bucket keeps returning the same wait
+	rl.Reserve(testUrl, "GET")
+	for i := 0; i < 3; i++ {
+		if wait, _ := rl.GetWaitFor(testUrl, "GET", LIMIT_STRATEGY_BURST); wait != 10*time.Second {
+			t.Errorf("Expected to wait for the reset, got %v", wait)
+		}
+	}
+
+	// Requests waiting in the queue go first
+	details, _ := urlHelper(testUrl, "GET")
+	_, leave := rl.joinQueues(details, queueRank(PRIORITY_NORMAL, false))
+	defer leave()
+	if wait, _ := rl.GetWaitFor(testUrl, "GET", LIMIT_STRATEGY_BURST); wait != 15*time.Second {
+		t.Errorf("Expected the slot behind the waiter, got %v", wait)
+	}
+}
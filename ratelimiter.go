@@ -1,8 +1,12 @@
 package ratelimiter
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,92 +15,247 @@ type RateLimits struct {
 	Counts     int
 	Duration   time.Duration
 	RetryAfter time.Duration
-	LastAt     time.Time
+	// Send time of the latest request the limits were learned from
+	LastAt time.Time
+	// Time the current window started, zero if unknown (LastAt is used instead)
+	WindowStart time.Time
+}
+
+// ResetAt returns when the current window of the limit resets
+func (l RateLimits) ResetAt() time.Time {
+	if l.WindowStart.IsZero() {
+		return l.LastAt.Add(l.Duration)
+	}
+	return l.WindowStart.Add(l.Duration)
 }
 
 // RateLimiter represents the rate limiting functionality
+// It is safe for concurrent use as long as the underlying Store is
 type RateLimiter struct {
 	cache Store
+
+	clock           Clock
+	defaultLimits   map[LimitType][]RateLimits
+	defaultStrategy LimitStrategy
+	safetyMargin    SafetyMargin
+	safetyMargins   map[LimitType]SafetyMargin
+	priorityShares  map[Priority]float64
+	tenants         map[string]*tenantAccount
+	tree            []BucketLevel
+	hooks           Hooks
+
+	// Every bucket seen so far and still in the store, used for snapshots
+	buckets     sync.Map
+	trackedKeys atomic.Uint64
+	pruning     atomic.Bool
+
+	// Service backoff state, by service bucket
+	backoffs sync.Map
+
+	// Requests waiting for slots, by bucket
+	queues   sync.Map
+	queueSeq atomic.Uint64
+
+	leaseDuration   atomic.Int64
+	leaseReclaimed  atomic.Pointer[func(key BucketKey, n int)]
+	reclaimedLeases atomic.Uint64
+
+	snapshotMu   sync.Mutex
+	snapshotPath string
+	snapshotStop chan struct{}
+	snapshotDone chan struct{}
 }
 
-func NewRateLimiter(store Store) *RateLimiter {
-	return &RateLimiter{
-		cache: store,
+// Creates a new RateLimiter backed by the given Store, configured by any options
+// Use NewStore() for the default in-memory store
+func NewRateLimiter(store Store, options ...Option) *RateLimiter {
+	rl := &RateLimiter{
+		cache:           store,
+		clock:           systemClock{},
+		defaultStrategy: LIMIT_STRATEGY_SPREAD,
+		tree:            defaultBucketTree(),
+	}
+	rl.leaseDuration.Store(int64(DEFAULT_LEASE_DURATION))
+	// Leases reclaimed by the janitor of a MemoryStore are reported like the ones the limiter reclaims
+	if memoryStore, ok := store.(*MemoryStore); ok {
+		memoryStore.OnLeaseReclaimed(rl.leasesReclaimed)
+	}
+
+	for _, option := range options {
+		option(rl)
 	}
+
+	return rl
 }
 
 // Reserve creates a reservation for a URL and method, incrementing the reservation count
-func (rl *RateLimiter) Reserve(url string, method string) error {
+// Complete or Cancel the returned Reservation once the request is done, otherwise it is reclaimed when its lease expires
+func (rl *RateLimiter) Reserve(url string, method string) (*Reservation, error) {
 	details, err := urlHelper(url, method)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	platform := details.PlatformName
-	methodKey := platform + ":" + details.ServiceName + ":" + details.MethodName
+	return rl.reserve(details), nil
+}
 
-	// Platform reserve key
-	platformReserveKey := platform + ":reserve"
-	if reserveCountRaw, exists := rl.cache.Get(platformReserveKey); exists {
-		if count, ok := reserveCountRaw.(int); ok {
-			rl.cache.Set(platformReserveKey, count+1)
-		}
-	} else {
-		rl.cache.Set(platformReserveKey, 1)
+// Reserves a slot for a request without checking the limits
+func (rl *RateLimiter) reserve(details *RateLimitDetails) *Reservation {
+	keys := rl.bucketPath(details)
+	rl.track(keys...)
+	rl.reclaim(keys...)
+	rl.seedDefaultLimits(details)
+
+	guaranteed := rl.withinGuarantee(details, rl.now())
+	lease := rl.newLease()
+	for _, key := range keys {
+		rl.cache.AddLease(key, lease)
 	}
 
-	// Method reserve key
-	methodReserveKey := methodKey + ":reserve"
-	if reserveCountRaw, exists := rl.cache.Get(methodReserveKey); exists {
-		if count, ok := reserveCountRaw.(int); ok {
-			rl.cache.Set(methodReserveKey, count+1)
-		}
-	} else {
-		rl.cache.Set(methodReserveKey, 1)
+	rl.admitTenant(details, guaranteed)
+	return newReservation(rl, details, lease)
+}
+
+// TryReserve atomically checks the burst limits for a URL and method and reserves a slot if one is free right now
+// Returns the Reservation if the slot was reserved, otherwise nil and how long to wait before trying again
+// With a shared Store this check covers every process using it
+func (rl *RateLimiter) TryReserve(url string, method string) (*Reservation, time.Duration, error) {
+	details, err := urlHelper(url, method)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return nil
+	return rl.tryReserve(details, PRIORITY_NORMAL)
+}
+
+// Reserves a slot for a request of the given priority if one is free right now
+func (rl *RateLimiter) tryReserve(details *RateLimitDetails, priority Priority) (*Reservation, time.Duration, error) {
+	keys := rl.bucketPath(details)
+	rl.track(keys...)
+	rl.reclaim(keys...)
+	rl.seedDefaultLimits(details)
+
+	now := rl.now()
+	if serviceWait := rl.serviceWait(details, now); serviceWait > 0 {
+		return nil, serviceWait, nil
+	}
+
+	guaranteed := rl.withinGuarantee(details, now)
+	lease := rl.newLease()
+	waitTime, reserved := rl.cache.CheckAndReserve(rl.priorityChecks(details, priority, guaranteed), lease, now)
+	if !reserved {
+		return nil, waitTime, nil
+	}
+
+	rl.admitTenant(details, guaranteed)
+	return newReservation(rl, details, lease), 0, nil
 }
 
-// RemoveReservationN reduces reservations for a URL and method by n (but not lower than 0)
+// RemoveReservationN reduces reservations for a URL and method by n (but not lower than 0), an n of 0 or less does nothing
+// The reservations expiring soonest are removed first
 func (rl *RateLimiter) RemoveReservationN(url string, method string, n int) error {
 	details, err := urlHelper(url, method)
 	if err != nil {
 		return err
 	}
 
-	platform := details.PlatformName
-	methodKey := platform + ":" + details.ServiceName + ":" + details.MethodName
+	rl.releaseN(details, n)
 
-	// Reduce platform reservation by n
-	platformReserveKey := platform + ":reserve"
-	if reserveCountRaw, exists := rl.cache.Get(platformReserveKey); exists {
-		if count, ok := reserveCountRaw.(int); ok {
-			newCount := count - n
-			if newCount < 0 {
-				newCount = 0
-			}
-			rl.cache.Set(platformReserveKey, newCount)
+	return nil
+}
+
+// Remembers bucket keys so they are included in snapshots
+// Every PRUNE_TRACKED_EVERY new keys, the ones the store no longer has are forgotten again in the background
+func (rl *RateLimiter) track(keys ...BucketKey) {
+	for _, key := range keys {
+		if _, loaded := rl.buckets.LoadOrStore(key, struct{}{}); !loaded && rl.trackedKeys.Add(1)%PRUNE_TRACKED_EVERY == 0 {
+			rl.pruneInBackground()
 		}
 	}
+}
+
+// Runs prune on its own goroutine, off the path of the request that crossed the threshold, unless one is already running
+func (rl *RateLimiter) pruneInBackground() {
+	if !rl.pruning.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer rl.pruning.Store(false)
+		rl.prune()
+	}()
+}
 
-	// Reduce method reservation by n
-	methodReserveKey := methodKey + ":reserve"
-	if reserveCountRaw, exists := rl.cache.Get(methodReserveKey); exists {
-		if count, ok := reserveCountRaw.(int); ok {
-			newCount := count - n
-			if newCount < 0 {
-				newCount = 0
+// Forgets the tracked buckets the store no longer has, along with their service backoff if it fully decayed
+// Keeps the memory of the limiter bounded when keys come and go, e.g. with a LabelLevel per end user
+func (rl *RateLimiter) prune() {
+	rl.buckets.Range(func(keyRaw, _ any) bool {
+		key := keyRaw.(BucketKey)
+		if rl.cache.Has(key) {
+			return true
+		}
+
+		rl.buckets.Delete(key)
+		if backoff, exists := rl.backoffs.Load(key); exists {
+			state := backoff.(*serviceBackoff)
+			state.mu.Lock()
+			if state.strikes == 0 {
+				rl.backoffs.CompareAndDelete(key, backoff)
 			}
-			rl.cache.Set(methodReserveKey, newCount)
+			state.mu.Unlock()
+		}
+		return true
+	})
+}
+
+// Replaces the limits of a bucket with those returned by update for its current ones, leaving its reservations untouched
+// Retries until the compare-and-swap succeeds so concurrent updates are never lost
+// Nothing is stored if update returns the current limits unchanged, returns the stored limits and whether they were stored
+func (rl *RateLimiter) updateLimits(key BucketKey, update func(current []RateLimits) []RateLimits) ([]RateLimits, bool) {
+	for {
+		state, _ := rl.cache.Get(key)
+		limits := update(state.Limits)
+		if limitsEqual(limits, state.Limits) {
+			return state.Limits, false
+		}
+
+		if rl.cache.CompareAndSwapLimits(key, state.Limits, limits, limitsTTL(limits)) {
+			return limits, true
 		}
 	}
+}
 
-	return nil
+// Installs limits on a bucket that doesn't have any yet, with their windows starting at the given time
+// Buckets that already have limits keep them
+func (rl *RateLimiter) seedLimits(key BucketKey, limits []RateLimits, now time.Time) {
+	seeded := make([]RateLimits, len(limits))
+	for i, limit := range limits {
+		seeded[i] = RateLimits{Limit: limit.Limit, Duration: limit.Duration, LastAt: now, WindowStart: now}
+	}
+	rl.cache.CompareAndSwapLimits(key, nil, seeded, limitsTTL(seeded))
+}
+
+// Stores the limits of a bucket, leaving its reservations untouched
+func (rl *RateLimiter) setLimits(key BucketKey, limits []RateLimits) {
+	rl.updateLimits(key, func([]RateLimits) []RateLimits { return limits })
+}
+
+// Counts a finished request against a bucket and merges in the limits learned from its response
+// Without limits (missing headers) only the request is counted, otherwise they are merged as described by reconcileLimits
+func (rl *RateLimiter) mergeLimits(key BucketKey, limits []RateLimits, sentAt time.Time) {
+	merged, updated := rl.updateLimits(key, func(current []RateLimits) []RateLimits {
+		if len(limits) == 0 {
+			return countRequest(current, sentAt)
+		}
+		return reconcileLimits(current, limits)
+	})
+
+	if updated && rl.hooks.OnLimitsUpdated != nil {
+		rl.hooks.OnLimitsUpdated(key, merged)
+	}
 }
 
 // Extracts platform, service, and method names from the URL and method
-// Then updates the ratelimits in the cache
+// Then updates the ratelimits in the cache, where they expire after their longest window
 // Returns an error if the URL or method is invalid
 func (rl *RateLimiter) UpdateRateLimits(url string, method string, limitType LimitType, limits []RateLimits) error {
 	details, err := urlHelper(url, method)
@@ -104,119 +263,112 @@ func (rl *RateLimiter) UpdateRateLimits(url string, method string, limitType Lim
 		return err
 	}
 
-	platform := details.PlatformName
-	methodKey := platform + ":" + details.ServiceName + ":" + details.MethodName
-
 	switch limitType {
-	case LIMIT_TYPE_METHOD:
-		rl.cache.Set(methodKey, limits)
-	case LIMIT_TYPE_APPLICATION:
-		rl.cache.Set(platform, limits)
+	case LIMIT_TYPE_METHOD, LIMIT_TYPE_APPLICATION:
+		key := details.bucketKey(limitType)
+		rl.track(key)
+		rl.setLimits(key, limits)
 	}
 
 	return nil
 }
 
 // Updates the rate limits based on URL, HTTP method and response headers
+// A response with a Retry-After header (a 429) blocks the scope named by X-Rate-Limit-Type until it has passed
+// This also releases one reservation for the URL and method
 func (rl *RateLimiter) UpdateFromHeaders(url string, method string, headers http.Header) error {
-	now := time.Now()
-
-	// Extract rate limit headers with default values
-	appRateLimit := headers.Get("X-App-Rate-Limit")
-	if appRateLimit == "" {
-		appRateLimit = "100:120,20:1"
-	}
-
-	appRateLimitCount := headers.Get("X-App-Rate-Limit-Count")
-	if appRateLimitCount == "" {
-		appRateLimitCount = "1:120,1:1"
+	details, err := urlHelper(url, method)
+	if err != nil {
+		return err
 	}
 
-	methodRateLimit := headers.Get("X-Method-Rate-Limit")
-	if methodRateLimit == "" {
-		methodRateLimit = "100:120,20:1"
-	}
+	return rl.updateFromHeaders(details, headers)
+}
 
-	methodRateLimitCount := headers.Get("X-Method-Rate-Limit-Count")
-	if methodRateLimitCount == "" {
-		methodRateLimitCount = "1:120,1:1"
-	}
+// Updates the rate limits of a request from its response headers, releasing one of its reservations
+func (rl *RateLimiter) updateFromHeaders(details *RateLimitDetails, headers http.Header) error {
+	rl.releaseN(details, 1)
+	return rl.updateFromResponse(details, 0, headers, rl.now())
+}
 
-	retryAfterStr := headers.Get("Retry-After")
-	if retryAfterStr == "" {
-		retryAfterStr = "0" // Default to 0 seconds if not provided
+// UpdateFromResponse updates the rate limits from a response to a request, like UpdateFromHeaders
+// Knowing the status code lets it also catch service 429s that come without any headers
+// This also releases one reservation for the URL and method
+func (rl *RateLimiter) UpdateFromResponse(resp *http.Response) error {
+	if resp.Request == nil {
+		return errors.New("response has no request to take the URL and method from")
 	}
 
-	retryAfter, err := strconv.ParseFloat(retryAfterStr, 64)
+	details, err := urlHelper(resp.Request.URL.String(), resp.Request.Method)
 	if err != nil {
 		return err
 	}
 
-	rl.RemoveReservationN(url, method, 1)
+	rl.releaseN(details, 1)
+	return rl.updateFromResponse(details, resp.StatusCode, resp.Header, rl.now())
+}
 
-	appLimitPairs, err := parseHeader(appRateLimit)
-	if err != nil {
-		return err
+// Updates the rate limits of a request from its response, status is 0 if it isn't known
+// sentAt is when the request was sent, which is what the limits are stamped with
+func (rl *RateLimiter) updateFromResponse(details *RateLimitDetails, status int, headers http.Header, sentAt time.Time) error {
+	now := rl.now()
+	appKey, methodKey := details.bucketKeys()
+	rl.track(appKey, methodKey)
+
+	retryAfter := time.Duration(0)
+	if retryAfterStr := headers.Get("Retry-After"); retryAfterStr != "" {
+		retryAfterSeconds, err := strconv.ParseFloat(retryAfterStr, 64)
+		if err != nil {
+			return errors.New("invalid Retry-After header: " + err.Error())
+		}
+		retryAfter = time.Duration(retryAfterSeconds * float64(time.Second))
 	}
 
-	appCountPairs, err := parseHeader(appRateLimitCount)
+	appRateLimits, err := limitsFromHeaders(headers, "X-App-Rate-Limit", "X-App-Rate-Limit-Count", retryAfter, sentAt)
 	if err != nil {
 		return err
 	}
 
-	methodLimitPairs, err := parseHeader(methodRateLimit)
+	methodRateLimits, err := limitsFromHeaders(headers, "X-Method-Rate-Limit", "X-Method-Rate-Limit-Count", retryAfter, sentAt)
 	if err != nil {
 		return err
 	}
 
-	methodCountPairs, err := parseHeader(methodRateLimitCount)
-	if err != nil {
-		return err
+	// Without headers (e.g. 5xx or proxy errors) the learned limits are kept, but the request still counts against them
+	rl.mergeLimits(appKey, appRateLimits, sentAt)
+	rl.mergeLimits(methodKey, methodRateLimits, sentAt)
+	rl.countTenant(details, sentAt)
+	rl.countLevels(details, sentAt)
+
+	// Retry-After is only sent with 429 responses, so it marks one when the status isn't known
+	switch {
+	case status == http.StatusTooManyRequests || (status == 0 && retryAfter > 0):
+		rl.block(details, headers.Get("X-Rate-Limit-Type"), retryAfter, now)
+	case status == 0 || (status >= 200 && status < 300):
+		rl.recoverService(details)
 	}
 
-	var appRateLimits []RateLimits
-	for i, limitPair := range appLimitPairs {
-		rateLimits := RateLimits{
-			Limit:      limitPair.Limit,
-			Duration:   time.Duration(limitPair.Duration) * time.Second,
-			RetryAfter: time.Duration(retryAfter) * time.Second,
-			LastAt:     now,
-		}
+	return nil
+}
 
-		if i < len(appCountPairs) {
-			rateLimits.Counts = appCountPairs[i].Limit
-		} else {
-			rateLimits.Counts = 0
+// Blocks the scope named by the X-Rate-Limit-Type header of a 429 for its Retry-After
+func (rl *RateLimiter) block(details *RateLimitDetails, limitType string, retryAfter time.Duration, now time.Time) {
+	switch scope := LimitType(strings.ToLower(limitType)); scope {
+	case LIMIT_TYPE_APPLICATION, LIMIT_TYPE_METHOD:
+		key := details.bucketKey(scope)
+		rl.track(key)
+		rl.cache.Block(key, now.Add(retryAfter))
+		if rl.hooks.OnBlocked != nil && retryAfter > 0 {
+			rl.hooks.OnBlocked(key, now.Add(retryAfter))
 		}
-
-		appRateLimits = append(appRateLimits, rateLimits)
+	default:
+		// Service 429s, and 429s without a type, come from the overloaded service behind the API
+		rl.backOffService(details, retryAfter, now)
 	}
-
-	var methodRateLimits []RateLimits
-	for i, limitPair := range methodLimitPairs {
-		rateLimits := RateLimits{
-			Limit:      limitPair.Limit,
-			Duration:   time.Duration(limitPair.Duration) * time.Second,
-			RetryAfter: time.Duration(retryAfter) * time.Second,
-			LastAt:     now,
-		}
-
-		if i < len(methodCountPairs) {
-			rateLimits.Counts = methodCountPairs[i].Limit
-		} else {
-			rateLimits.Counts = 0
-		}
-
-		methodRateLimits = append(methodRateLimits, rateLimits)
-	}
-
-	rl.UpdateRateLimits(url, method, LIMIT_TYPE_APPLICATION, appRateLimits)
-	rl.UpdateRateLimits(url, method, LIMIT_TYPE_METHOD, methodRateLimits)
-
-	return nil
 }
 
 // GetWaitFor calculates the wait time for a given URL, HTTP method, and limit strategy
+// An empty strategy uses the default one of the limiter, unknown strategies are rejected, see RegisterStrategy
 func (rl *RateLimiter) GetWaitFor(url string, httpMethod string, strategy LimitStrategy) (time.Duration, error) {
 	// Parse URL and method to get platform, service and method details
 	details, err := urlHelper(url, httpMethod)
@@ -224,101 +376,44 @@ func (rl *RateLimiter) GetWaitFor(url string, httpMethod string, strategy LimitS
 		return 0, err
 	}
 
-	now := time.Now()
-
-	// Generate keys for cache lookup
-	platform := details.PlatformName
-	methodKey := platform + ":" + details.ServiceName + ":" + details.MethodName
-
-	// Get application limits from cache
-	appLimits := []RateLimits{}
-	if appLimitsRaw, exists := rl.cache.Get(platform); exists {
-		if limits, ok := appLimitsRaw.([]RateLimits); ok {
-			appLimits = limits
-		}
-	}
-
-	// Get method limits from cache
-	methodLimits := []RateLimits{}
-	if methodLimitsRaw, exists := rl.cache.Get(methodKey); exists {
-		if limits, ok := methodLimitsRaw.([]RateLimits); ok {
-			methodLimits = limits
-		}
-	}
-
-	platformReserveCount := 0
-	if reserveCountRaw, exists := rl.cache.Get(platform + ":reserve"); exists {
-		if count, ok := reserveCountRaw.(int); ok {
-			platformReserveCount = count
-		}
-	}
+	return rl.getWaitFor(details, strategy)
+}
 
-	methodReserveCount := 0
-	if reserveCountRaw, exists := rl.cache.Get(methodKey + ":reserve"); exists {
-		if count, ok := reserveCountRaw.(int); ok {
-			methodReserveCount = count
-		}
+// Calculates the wait time for a request, behind the requests already waiting in the queues of its buckets, see GetWaitFor
+func (rl *RateLimiter) getWaitFor(details *RateLimitDetails, name LimitStrategy) (time.Duration, error) {
+	strategy, err := rl.strategy(name)
+	if err != nil {
+		return 0, err
 	}
 
-	allLimits := append(appLimits, methodLimits...)
-	waitTime := time.Duration(0)
+	rl.reclaim(rl.bucketPath(details)...)
+	rl.seedDefaultLimits(details)
 
-	if strategy == LIMIT_STRATEGY_BURST {
-		for i, limit := range allLimits {
-			// Add reservation count to effective counts
-			reserveCount := platformReserveCount
-			if i >= len(appLimits) {
-				// This is a method limit, use method reserve count
-				reserveCount = methodReserveCount
-			}
+	now := rl.now()
+	waitTime := max(rl.waitFor(details, strategy, 0), rl.nextSlot(details, now).Sub(now))
+	rl.notifyWait(details, waitTime)
 
-			// Check if current count + reservations >= limit
-			if limit.Counts+reserveCount >= limit.Limit {
-				timeElapsed := now.Sub(limit.LastAt)
-				if timeElapsed < limit.Duration {
-					tempWait := limit.Duration - timeElapsed
-					if tempWait > waitTime {
-						waitTime = tempWait
-					}
-				}
-			}
-		}
-	} else {
-		for i, limit := range allLimits {
-			// Add reservation count to effective counts
-			reserveCount := platformReserveCount
-			if i >= len(appLimits) {
-				// This is a method limit, use method reserve count
-				reserveCount = methodReserveCount
-			}
+	return waitTime, nil
+}
 
-			effectiveCounts := limit.Counts + reserveCount
-
-			if effectiveCounts >= limit.Limit {
-				timeElapsed := now.Sub(limit.LastAt)
-				if timeElapsed < limit.Duration {
-					tempWait := limit.Duration - timeElapsed
-					if tempWait > waitTime {
-						waitTime = tempWait
-					}
-				}
-			} else {
-				timeElapsed := now.Sub(limit.LastAt)
-				if timeElapsed < limit.Duration {
-					remainingRequests := limit.Limit - effectiveCounts
-					remainingTime := limit.Duration - timeElapsed
-
-					if remainingRequests > 0 && remainingTime > 0 {
-						averageWaitTime := remainingTime / time.Duration(remainingRequests)
-						if averageWaitTime > waitTime {
-							waitTime = averageWaitTime
-						}
-					}
-				}
-			}
+// Calculates the wait time for the buckets of a request, the longest the strategy returns for any of them
+// ownReservations is the number of reservations held by the caller, which don't count against it
+func (rl *RateLimiter) waitFor(details *RateLimitDetails, strategy Strategy, ownReservations int) time.Duration {
+	now := rl.now()
+
+	waitTime := rl.serviceWait(details, now)
+	for _, check := range rl.bucketChecks(details) {
+		state, _ := rl.cache.Get(check.Key)
+		waitTime = max(waitTime, state.blockWait(now))
+
+		// Build a new slice so the cached limits are never written to, with the safety margin of the bucket taken off
+		limits := make([]RateLimits, len(state.Limits))
+		for i, limit := range state.Limits {
+			limit.Limit = check.Margin.apply(limit.Limit)
+			limits[i] = limit
 		}
+		waitTime = max(waitTime, strategy.Wait(limits, max(state.Reserved()-ownReservations, 0), rl.clock))
 	}
 
-	// Return the calculated wait time
-	return waitTime - time.Since(now), nil
+	return waitTime - rl.now().Sub(now)
 }
@@ -0,0 +1,417 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testUrl = "https://na1.api.riotgames.com/lol/summoner/v4/summoners/me"
+
+func TestConcurrentReservations(t *testing.T) {
+	store := NewStore()
+	rl := NewRateLimiter(store)
+
+	const workers = 500
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := rl.Reserve(testUrl, "GET"); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if _, err := rl.GetWaitFor(testUrl, "GET", LIMIT_STRATEGY_SPREAD); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, key := range []BucketKey{testAppKey, testMethodKey} {
+		if state, _ := store.Get(key); state.Reserved() != workers {
+			t.Errorf("Expected %d reservations for %s, got %d", workers, key, state.Reserved())
+		}
+	}
+
+	headers := http.Header{}
+	headers.Set("X-App-Rate-Limit", "100:120,20:1")
+	headers.Set("X-App-Rate-Limit-Count", "5:120,5:1")
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rl.UpdateFromHeaders(testUrl, "GET", headers); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, key := range []BucketKey{testAppKey, testMethodKey} {
+		if state, _ := store.Get(key); state.Reserved() != 0 {
+			t.Errorf("Expected no reservations left for %s, got %d", key, state.Reserved())
+		}
+	}
+}
+
+func TestReservationIsReleasedOnce(t *testing.T) {
+	store := NewStore()
+	rl := NewRateLimiter(store)
+
+	first, err := rl.Reserve(testUrl, "GET")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, _ := rl.Reserve(testUrl, "GET")
+	third, _ := rl.Reserve(testUrl, "GET")
+
+	first.Cancel()
+	first.Cancel()
+	if err := first.Complete(http.Header{}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if state, _ := store.Get(testAppKey); state.Reserved() != 2 {
+		t.Errorf("Expected a cancelled reservation to be released exactly once, got %d left", state.Reserved())
+	}
+
+	headers := http.Header{}
+	headers.Set("X-App-Rate-Limit", "100:120")
+	headers.Set("X-App-Rate-Limit-Count", "3:120")
+	second.Complete(headers)
+	second.Complete(headers)
+	second.Cancel()
+
+	state, _ := store.Get(testAppKey)
+	if state.Reserved() != 1 {
+		t.Errorf("Expected a completed reservation to be released exactly once, got %d left", state.Reserved())
+	}
+	if len(state.Limits) != 1 || state.Limits[0].Counts != 3 {
+		t.Errorf("Expected the limits to be updated from the headers, got %v", state.Limits)
+	}
+
+	third.Cancel()
+
+	// Reserve returns a nil reservation for an unknown endpoint, finishing it does nothing
+	unknown, err := rl.Reserve("https://ddragon.leagueoflegends.com/api/versions.json", "GET")
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown endpoint")
+	}
+	unknown.MarkSent()
+	unknown.Cancel()
+	if err := unknown.Complete(headers); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := unknown.CompleteResponse(&http.Response{StatusCode: http.StatusOK}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestExpiredLeasesAreReclaimed(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
+	rl := NewRateLimiter(store, WithClock(clock))
+	rl.SetLeaseDuration(10 * time.Millisecond)
+
+	var mu sync.Mutex
+	reclaimed := map[BucketKey]int{}
+	rl.OnLeaseReclaimed(func(key BucketKey, n int) {
+		mu.Lock()
+		reclaimed[key] += n
+		mu.Unlock()
+	})
+
+	leaked, _ := rl.Reserve(testUrl, "GET")
+	rl.Reserve(testUrl, "GET")
+	if leaked.ExpiresAt().IsZero() {
+		t.Errorf("Expected the reservation to have a lease")
+	}
+
+	clock.Advance(20 * time.Millisecond)
+
+	if state, _ := store.Get(testAppKey); state.Reserved() != 0 {
+		t.Errorf("Expected expired leases to stop counting, got %d", state.Reserved())
+	}
+
+	rl.SetLeaseDuration(time.Minute)
+	if _, err := rl.Reserve(testUrl, "GET"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if count := rl.ReclaimedLeases(); count != 4 {
+		t.Errorf("Expected 2 leases reclaimed from each bucket, got %d", count)
+	}
+	mu.Lock()
+	if reclaimed[testAppKey] != 2 || reclaimed[testMethodKey] != 2 {
+		t.Errorf("Expected the callback to report 2 leases per bucket, got %v", reclaimed)
+	}
+	mu.Unlock()
+
+	leaked.Cancel()
+	if state, _ := store.Get(testAppKey); state.Reserved() != 1 {
+		t.Errorf("Expected cancelling a reclaimed reservation to leave others alone, got %d", state.Reserved())
+	}
+}
+
+func TestRetryAfterBlocksScope(t *testing.T) {
+	tests := []struct {
+		name        string
+		limitType   string
+		expectBlock BucketKey
+	}{
+		{name: "Application", limitType: "application", expectBlock: testAppKey},
+		{name: "Method", limitType: "method", expectBlock: testMethodKey},
+		{name: "Service", limitType: "service", expectBlock: testServiceKey},
+		{name: "Missing type", limitType: "", expectBlock: testServiceKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewStore()
+			rl := NewRateLimiter(store)
+
+			headers := http.Header{}
+			headers.Set("Retry-After", "2")
+			headers.Set("X-Rate-Limit-Type", tt.limitType)
+			if err := rl.UpdateFromHeaders(testUrl, "GET", headers); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			for _, key := range []BucketKey{testAppKey, testMethodKey, testServiceKey} {
+				state, _ := store.Get(key)
+				if blocked := !state.BlockedUntil.IsZero(); blocked != (key == tt.expectBlock) {
+					t.Errorf("Expected %s blocked to be %v, got %v", key, key == tt.expectBlock, state.BlockedUntil)
+				}
+			}
+
+			wait, _ := rl.GetWaitFor(testUrl, "GET", LIMIT_STRATEGY_BURST)
+			if wait < time.Second || wait > 2*time.Second {
+				t.Errorf("Expected to wait for the Retry-After, got %v", wait)
+			}
+			if _, wait, _ := rl.TryReserve(testUrl, "GET"); wait < time.Second {
+				t.Errorf("Expected TryReserve to be blocked, got %v", wait)
+			}
+		})
+	}
+}
+
+func TestServiceBackoff(t *testing.T) {
+	store := NewStore()
+	rl := NewRateLimiter(store)
+	request, _ := http.NewRequest(http.MethodGet, testUrl, nil)
+
+	respond := func(status int) time.Duration {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}, Request: request}
+		if err := rl.UpdateFromResponse(resp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		state, _ := store.Get(testServiceKey)
+		return time.Until(state.BlockedUntil)
+	}
+
+	// A 429 without any headers still backs off, doubling with every strike
+	for strikes, expected := range []time.Duration{SERVICE_BACKOFF_BASE, 2 * SERVICE_BACKOFF_BASE, 4 * SERVICE_BACKOFF_BASE} {
+		store.Remove(testServiceKey)
+		if wait := respond(http.StatusTooManyRequests); wait < expected/2-time.Second/10 || wait > expected {
+			t.Errorf("Expected a backoff between %v and %v after %d strikes, got %v", expected/2, expected, strikes+1, wait)
+		}
+	}
+
+	// Two successes decay the backoff by two strikes
+	respond(http.StatusOK)
+	respond(http.StatusOK)
+	store.Remove(testServiceKey)
+	if wait := respond(http.StatusTooManyRequests); wait > 2*SERVICE_BACKOFF_BASE {
+		t.Errorf("Expected the backoff to decay after successes, got %v", wait)
+	}
+
+	if wait, _ := rl.GetWaitFor(testUrl, "GET", LIMIT_STRATEGY_BURST); wait <= 0 {
+		t.Errorf("Expected the service backoff to be waited for, got %v", wait)
+	}
+	if err := rl.UpdateFromResponse(&http.Response{StatusCode: http.StatusOK}); err == nil {
+		t.Errorf("Expected an error for a response without a request")
+	}
+}
+
+func TestUpdateFromHeadersWithoutLimits(t *testing.T) {
+	store := NewStore()
+	rl := NewRateLimiter(store)
+
+	headers := http.Header{}
+	headers.Set("X-App-Rate-Limit", "500:10,30000:600")
+	headers.Set("X-App-Rate-Limit-Count", "40:10,900:600")
+	headers.Set("X-Method-Rate-Limit", "2000:60")
+	headers.Set("X-Method-Rate-Limit-Count", "10:60")
+	if err := rl.UpdateFromHeaders(testUrl, "GET", headers); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A 5xx from a proxy carries no rate limit headers at all
+	if err := rl.UpdateFromHeaders(testUrl, "GET", http.Header{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		key    BucketKey
+		limits []int
+		counts []int
+	}{
+		{key: testAppKey, limits: []int{500, 30000}, counts: []int{41, 901}},
+		{key: testMethodKey, limits: []int{2000}, counts: []int{11}},
+	}
+
+	for _, tt := range tests {
+		state, _ := store.Get(tt.key)
+		if len(state.Limits) != len(tt.limits) {
+			t.Fatalf("Expected %d limits for %s, got %v", len(tt.limits), tt.key, state.Limits)
+		}
+		for i, limit := range state.Limits {
+			if limit.Limit != tt.limits[i] || limit.Counts != tt.counts[i] {
+				t.Errorf("Expected %d/%d for %s, got %d/%d", tt.counts[i], tt.limits[i], tt.key, limit.Counts, limit.Limit)
+			}
+		}
+	}
+}
+
+func TestMalformedHeadersAreNamed(t *testing.T) {
+	tests := []struct {
+		header string
+		value  string
+	}{
+		{header: "X-App-Rate-Limit", value: "lots"},
+		{header: "X-App-Rate-Limit-Count", value: "some"},
+		{header: "X-Method-Rate-Limit", value: "many"},
+		{header: "X-Method-Rate-Limit-Count", value: "few"},
+		{header: "Retry-After", value: "soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			headers := http.Header{}
+			headers.Set("X-App-Rate-Limit", "100:120")
+			headers.Set("X-App-Rate-Limit-Count", "1:120")
+			headers.Set("X-Method-Rate-Limit", "100:120")
+			headers.Set("X-Method-Rate-Limit-Count", "1:120")
+			headers.Set(tt.header, tt.value)
+
+			err := NewRateLimiter(NewStore()).UpdateFromHeaders(testUrl, "GET", headers)
+			if err == nil || !strings.Contains(err.Error(), tt.header+" header") {
+				t.Errorf("Expected an error naming %s, got %v", tt.header, err)
+			}
+		})
+	}
+}
+
+func TestWaitUntilWindowReset(t *testing.T) {
+	rl := NewRateLimiter(NewStore())
+	now := time.Now()
+	limits := []RateLimits{{Limit: 10, Counts: 10, Duration: time.Minute, LastAt: now, WindowStart: now.Add(-50 * time.Second)}}
+	if err := rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	wait, _ := rl.GetWaitFor(testUrl, "GET", LIMIT_STRATEGY_BURST)
+	if wait > 10*time.Second || wait < 9*time.Second {
+		t.Errorf("Expected to wait until the window resets in 10s, got %v", wait)
+	}
+}
+
+func TestLocalCountsUnderConcurrency(t *testing.T) {
+	store := NewStore()
+	rl := NewRateLimiter(store)
+
+	headers := http.Header{}
+	headers.Set("X-App-Rate-Limit", "100:60")
+	headers.Set("X-App-Rate-Limit-Count", "10:60")
+	if err := rl.UpdateFromHeaders(testUrl, "GET", headers); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Every response reports the same stale count, but each one is a request that happened
+	stale := http.Header{}
+	stale.Set("X-App-Rate-Limit", "100:60")
+	stale.Set("X-App-Rate-Limit-Count", "11:60")
+
+	const workers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reservation, _ := rl.Reserve(testUrl, "GET")
+			if err := reservation.Complete(stale); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	state, _ := store.Get(testAppKey)
+	if len(state.Limits) != 1 || state.Limits[0].Counts != 10+workers {
+		t.Errorf("Expected every finished request to be counted, got %v", state.Limits)
+	}
+}
+
+func TestOutOfOrderResponses(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
+	rl := NewRateLimiter(store, WithClock(clock))
+
+	older, _ := rl.Reserve(testUrl, "GET")
+	clock.Advance(time.Millisecond)
+	newer, _ := rl.Reserve(testUrl, "GET")
+	newer.MarkSent()
+
+	respond := func(reservation *Reservation, count string) {
+		headers := http.Header{}
+		headers.Set("X-App-Rate-Limit", "100:120")
+		headers.Set("X-App-Rate-Limit-Count", count+":120")
+		if err := reservation.Complete(headers); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	respond(newer, "8")
+	state, _ := store.Get(testAppKey)
+	sentAt := state.Limits[0].LastAt
+
+	respond(older, "3")
+	state, _ = store.Get(testAppKey)
+	if state.Limits[0].Counts != 8 {
+		t.Errorf("Expected the older response to already be part of the newer count, got %d", state.Limits[0].Counts)
+	}
+	if !state.Limits[0].LastAt.Equal(sentAt) || !state.Limits[0].WindowStart.Equal(sentAt) {
+		t.Errorf("Expected the newer request to stay the latest, got %v", state.Limits[0])
+	}
+}
+
+func TestOutOfOrderFirstResponse(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
+	rl := NewRateLimiter(store, WithClock(clock))
+
+	first, _ := rl.Reserve(testUrl, "GET")
+	clock.Advance(time.Second)
+	second, _ := rl.Reserve(testUrl, "GET")
+	second.MarkSent()
+
+	headers := func(count string) http.Header {
+		headers := http.Header{}
+		headers.Set("X-App-Rate-Limit", "100:120")
+		headers.Set("X-App-Rate-Limit-Count", count+":120")
+		return headers
+	}
+	second.Complete(headers("2"))
+	first.Complete(headers("1"))
+
+	state, _ := store.Get(testAppKey)
+	if state.Limits[0].Counts != 2 {
+		t.Errorf("Expected both requests to be counted once, got %d", state.Limits[0].Counts)
+	}
+	if !state.Limits[0].WindowStart.Equal(first.sentTime()) {
+		t.Errorf("Expected the window to start with the first request at %v, got %v", first.sentTime(), state.Limits[0].WindowStart)
+	}
+}
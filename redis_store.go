@@ -0,0 +1,671 @@
+package ratelimiter
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ Store = (*RedisStore)(nil)
+
+// RedisOptions configures a RedisStore
+type RedisOptions struct {
+	// Address of the redis server, defaults to "localhost:6379"
+	Addr string
+	// Password used with AUTH, skipped if empty
+	Password string
+	// Database selected with SELECT
+	DB int
+	// Prefix added to every key, defaults to "ratelimiter:"
+	Prefix string
+	// Maximum number of idle connections kept open, defaults to 8
+	PoolSize int
+	// Timeout for dialing and for every command, defaults to 5 seconds
+	Timeout time.Duration
+	// Called with every error returned by redis, since the Store interface has no error returns
+	OnError func(error)
+	// Clock used for the times sent to redis, defaults to the system time
+	// Keys still expire by the clock of the redis server
+	Clock Clock
+}
+
+// Implements the Store interface on top of a redis server
+// Every read-modify-write operation runs as a Lua script, so it is atomic across all processes sharing the server
+// Each bucket uses up to three keys: its limits as JSON, a sorted set of its leases scored by their expiry in milliseconds
+// that expires with the latest of them, and the time it is blocked until in nanoseconds
+type RedisStore struct {
+	options RedisOptions
+	pool    chan *redisConn
+}
+
+// A single connection to the redis server
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// A Lua script along with its SHA1, so it can be sent with EVALSHA
+type redisScript struct {
+	source string
+	sha    string
+}
+
+func newRedisScript(source string) *redisScript {
+	sum := sha1.Sum([]byte(source))
+	return &redisScript{source: source, sha: hex.EncodeToString(sum[:])}
+}
+
+// Limits are stored as JSON arrays, anything else counts as no limits in the scripts below
+// Leases expire once the current time in milliseconds reaches their score, so only scores above it count as active
+// Defines expireLeases, which expires a leases key along with its latest lease given the current time in milliseconds
+// so the leases of a bucket that is never used again don't stay forever
+const redisExpireLeases = `
+local function expireLeases(key, now)
+	local latest = redis.call('ZRANGE', key, -1, -1, 'WITHSCORES')
+	if #latest == 2 then
+		redis.call('PEXPIRE', key, math.max(math.ceil(tonumber(latest[2]) - now), 1))
+	end
+end
+`
+
+// ARGV holds the expiry and the ID of the lease followed by the current time in milliseconds
+var redisAddLeaseScript = newRedisScript(redisExpireLeases + `
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+expireLeases(KEYS[1], tonumber(ARGV[3]))
+return redis.call('ZCOUNT', KEYS[1], '(' .. ARGV[3], '+inf')
+`)
+
+// ARGV holds the number of leases to remove followed by the current time in milliseconds
+var redisRemoveLeasesNScript = newRedisScript(`
+if tonumber(ARGV[1]) > 0 then
+	local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '(' .. ARGV[2], '+inf', 'LIMIT', 0, tonumber(ARGV[1]))
+	if #ids > 0 then
+		redis.call('ZREM', KEYS[1], unpack(ids))
+	end
+end
+return redis.call('ZCOUNT', KEYS[1], '(' .. ARGV[2], '+inf')
+`)
+
+var redisCompareAndSwapScript = newRedisScript(`
+local current = redis.call('GET', KEYS[1])
+if not current or string.sub(current, 1, 1) ~= '[' or current == '[]' then
+	current = ''
+end
+if current ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// ARGV holds the time to block until in nanoseconds followed by the time left until then in milliseconds
+var redisBlockScript = newRedisScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0') or 0
+if tonumber(ARGV[1]) > current then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+end
+return 1
+`)
+
+// KEYS holds the limits keys followed by the matching leases keys and blocked keys
+// ARGV holds the current time in nanoseconds and in milliseconds, followed by the expiry and the ID of the lease
+// and then the safety margin (percent and count) and the held requests of every bucket
+// Returns {1, 0} when a slot was reserved, {0, wait in nanoseconds} otherwise
+var redisCheckAndReserveScript = newRedisScript(redisExpireLeases + `
+local now = tonumber(ARGV[1])
+local n = #KEYS / 3
+local wait = 0
+for i = 1, n do
+	local percent = tonumber(ARGV[1 + 4 * i])
+	local count = tonumber(ARGV[2 + 4 * i])
+	local held = tonumber(ARGV[3 + 4 * i])
+	local windows = cjson.decode(ARGV[4 + 4 * i])
+	local blocked = tonumber(redis.call('GET', KEYS[2 * n + i]) or '0') or 0
+	if blocked - now > wait then
+		wait = blocked - now
+	end
+	local raw = redis.call('GET', KEYS[i])
+	local reserved = redis.call('ZCOUNT', KEYS[n + i], '(' .. ARGV[2], '+inf')
+	if raw and string.sub(raw, 1, 1) == '[' then
+		for _, limit in ipairs(cjson.decode(raw)) do
+			local usable = math.max(limit.l - math.max(math.floor(limit.l * percent / 100), count), 1)
+			local start = limit.t
+			if limit.w and limit.w ~= 0 then
+				start = limit.w
+			end
+			local counts = limit.c
+			local reset = start + limit.d
+			if reset <= now then
+				counts = 0
+				reset = now + limit.d
+			end
+			local windowHeld = 0
+			for _, window in ipairs(windows) do
+				if window[1] == limit.d then
+					windowHeld = window[2]
+				end
+			end
+			if counts + reserved + held + windowHeld >= usable and reset - now > wait then
+				wait = reset - now
+			end
+		end
+	end
+end
+if wait > 0 then
+	return {0, math.ceil(wait)}
+end
+for i = 1, n do
+	redis.call('ZADD', KEYS[n + i], ARGV[3], ARGV[4])
+	expireLeases(KEYS[n + i], tonumber(ARGV[2]))
+end
+return {1, 0}
+`)
+
+// Encodes the requests a check holds per window duration as a JSON array of [duration in nanoseconds, count] pairs
+func redisHeldInWindow(check BucketCheck) string {
+	windows := make([][2]int64, 0, len(check.HeldInWindow))
+	for duration, held := range check.HeldInWindow {
+		windows = append(windows, [2]int64{int64(duration), int64(held)})
+	}
+	encoded, _ := json.Marshal(windows)
+	return string(encoded)
+}
+
+// JSON representation of RateLimits used in redis, with durations and times in nanoseconds
+type redisRateLimits struct {
+	Limit       int   `json:"l"`
+	Counts      int   `json:"c"`
+	Duration    int64 `json:"d"`
+	RetryAfter  int64 `json:"r"`
+	LastAt      int64 `json:"t"`
+	WindowStart int64 `json:"w,omitempty"`
+}
+
+// Creates a new RedisStore, connections are opened lazily
+func NewRedisStore(options RedisOptions) *RedisStore {
+	if options.Addr == "" {
+		options.Addr = "localhost:6379"
+	}
+	if options.Prefix == "" {
+		options.Prefix = "ratelimiter:"
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = 8
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+	if options.Clock == nil {
+		options.Clock = systemClock{}
+	}
+
+	return &RedisStore{
+		options: options,
+		pool:    make(chan *redisConn, options.PoolSize),
+	}
+}
+
+// Returns the redis keys holding the limits and the leases of a bucket
+func (s *RedisStore) redisKeys(key BucketKey) (string, string) {
+	limitsKey := s.options.Prefix + key.String()
+	return limitsKey, limitsKey + ":leases"
+}
+
+// Returns the redis key holding the time a bucket is blocked until
+func (s *RedisStore) redisBlockedKey(key BucketKey) string {
+	return s.options.Prefix + key.String() + ":blocked"
+}
+
+// Stores the state of a bucket in redis, with its limits expiring after ttl (a ttl of 0 never expires)
+func (s *RedisStore) Set(key BucketKey, state BucketState, ttl time.Duration) {
+	limitsKey, leasesKey := s.redisKeys(key)
+
+	if len(state.Limits) == 0 {
+		s.do("DEL", limitsKey)
+	} else if ttl > 0 {
+		s.do("SET", limitsKey, encodeRedisLimits(state.Limits), "PX", strconv.FormatInt(redisMilliseconds(ttl), 10))
+	} else {
+		s.do("SET", limitsKey, encodeRedisLimits(state.Limits))
+	}
+
+	if blockWait := state.blockWait(s.options.Clock.Now()); blockWait > 0 {
+		s.do("SET", s.redisBlockedKey(key), strconv.FormatInt(state.BlockedUntil.UnixNano(), 10), "PX", strconv.FormatInt(redisMilliseconds(blockWait), 10))
+	} else {
+		s.do("DEL", s.redisBlockedKey(key))
+	}
+
+	s.do("DEL", leasesKey)
+	now := s.options.Clock.Now()
+	leases := activeLeases(state.Leases, now)
+	if len(leases) > 0 {
+		command := []string{"ZADD", leasesKey}
+		latestExpiry := now
+		for _, lease := range leases {
+			command = append(command, redisLeaseScore(lease.ExpiresAt), lease.ID)
+			latestExpiry = latest(latestExpiry, lease.ExpiresAt)
+		}
+		s.do(command...)
+		// The leases key expires along with its latest lease, see redisExpireLeases
+		s.do("PEXPIRE", leasesKey, strconv.FormatInt(redisMilliseconds(latestExpiry.Sub(now)), 10))
+	}
+}
+
+// Retrieves the state of a bucket from redis, leaving out expired leases
+// Returns the state and a boolean indicating if the bucket was found
+func (s *RedisStore) Get(key BucketKey) (BucketState, bool) {
+	limitsKey, leasesKey := s.redisKeys(key)
+
+	state := BucketState{}
+	reply, err := s.do("MGET", limitsKey, s.redisBlockedKey(key))
+	if values, ok := reply.([]any); err == nil && ok && len(values) == 2 {
+		if raw, ok := values[0].(string); ok {
+			state.Limits = decodeRedisLimits(raw)
+		}
+		if raw, ok := values[1].(string); ok {
+			blockedUntil, _ := strconv.ParseInt(raw, 10, 64)
+			if until := time.Unix(0, blockedUntil); until.After(s.options.Clock.Now()) {
+				state.BlockedUntil = until
+			}
+		}
+	}
+
+	reply, err = s.do("ZRANGEBYSCORE", leasesKey, "("+redisLeaseScore(s.options.Clock.Now()), "+inf", "WITHSCORES")
+	if err == nil {
+		values, _ := reply.([]any)
+		for i := 0; i+1 < len(values); i += 2 {
+			id, _ := values[i].(string)
+			raw, _ := values[i+1].(string)
+			score, _ := strconv.ParseInt(raw, 10, 64)
+			state.Leases = append(state.Leases, Lease{ID: id, ExpiresAt: time.UnixMilli(score)})
+		}
+	}
+
+	return state, len(state.Limits) > 0 || len(state.Leases) > 0 || !state.BlockedUntil.IsZero()
+}
+
+// Checks if a bucket exists in redis
+func (s *RedisStore) Has(key BucketKey) bool {
+	limitsKey, leasesKey := s.redisKeys(key)
+	reply, err := s.do("EXISTS", limitsKey, leasesKey, s.redisBlockedKey(key))
+	count, _ := reply.(int64)
+	return err == nil && count > 0
+}
+
+// Removes a bucket from redis
+// Returns true if the bucket was found and removed, false otherwise
+func (s *RedisStore) Remove(key BucketKey) bool {
+	limitsKey, leasesKey := s.redisKeys(key)
+	reply, err := s.do("DEL", limitsKey, leasesKey, s.redisBlockedKey(key))
+	count, _ := reply.(int64)
+	return err == nil && count > 0
+}
+
+// Atomically blocks a bucket until the given time, unless it is already blocked for longer
+func (s *RedisStore) Block(key BucketKey, until time.Time) {
+	blockWait := until.Sub(s.options.Clock.Now())
+	if blockWait <= 0 {
+		return
+	}
+
+	s.eval(
+		redisBlockScript,
+		[]string{s.redisBlockedKey(key)},
+		strconv.FormatInt(until.UnixNano(), 10),
+		strconv.FormatInt(redisMilliseconds(blockWait), 10),
+	)
+}
+
+// Atomically adds a lease to a bucket and returns the number of leases it holds
+func (s *RedisStore) AddLease(key BucketKey, lease Lease) int {
+	_, leasesKey := s.redisKeys(key)
+	reply, err := s.eval(redisAddLeaseScript, []string{leasesKey}, redisLeaseScore(lease.ExpiresAt), lease.ID, redisLeaseScore(s.options.Clock.Now()))
+	if err != nil {
+		return 0
+	}
+	count, _ := reply.(int64)
+	return int(count)
+}
+
+// Atomically removes a lease from a bucket, returns true if the bucket held it
+func (s *RedisStore) RemoveLease(key BucketKey, id string) bool {
+	_, leasesKey := s.redisKeys(key)
+	reply, err := s.do("ZREM", leasesKey, id)
+	count, _ := reply.(int64)
+	return err == nil && count > 0
+}
+
+// Atomically removes the n leases of a bucket that expire soonest and returns the number of leases left
+func (s *RedisStore) RemoveLeasesN(key BucketKey, n int) int {
+	_, leasesKey := s.redisKeys(key)
+	reply, err := s.eval(redisRemoveLeasesNScript, []string{leasesKey}, strconv.Itoa(n), redisLeaseScore(s.options.Clock.Now()))
+	if err != nil {
+		return 0
+	}
+	count, _ := reply.(int64)
+	return int(count)
+}
+
+// Atomically removes the leases of a bucket that expired by the given time and returns how many were removed
+func (s *RedisStore) ReclaimLeases(key BucketKey, now time.Time) int {
+	_, leasesKey := s.redisKeys(key)
+	reply, err := s.do("ZREMRANGEBYSCORE", leasesKey, "-inf", redisLeaseScore(now))
+	if err != nil {
+		return 0
+	}
+	count, _ := reply.(int64)
+	return int(count)
+}
+
+// Atomically replaces the limits of a bucket with new if they currently equal old
+func (s *RedisStore) CompareAndSwapLimits(key BucketKey, old []RateLimits, new []RateLimits, ttl time.Duration) bool {
+	limitsKey, _ := s.redisKeys(key)
+
+	encodedOld := ""
+	if len(old) > 0 {
+		encodedOld = encodeRedisLimits(old)
+	}
+
+	ttlMilliseconds := int64(0)
+	if ttl > 0 {
+		ttlMilliseconds = redisMilliseconds(ttl)
+	}
+
+	reply, err := s.eval(
+		redisCompareAndSwapScript,
+		[]string{limitsKey},
+		encodedOld,
+		encodeRedisLimits(new),
+		strconv.FormatInt(ttlMilliseconds, 10),
+	)
+	return err == nil && reply == int64(1)
+}
+
+// Atomically checks every bucket against its limits and reservations and adds the lease to all of them if possible
+// The whole check runs on the redis server, so it sees the counts and reservations of every process
+func (s *RedisStore) CheckAndReserve(checks []BucketCheck, lease Lease, now time.Time) (time.Duration, bool) {
+	redisKeys := make([]string, len(checks)*3)
+	args := []string{
+		strconv.FormatInt(now.UnixNano(), 10),
+		redisLeaseScore(now),
+		redisLeaseScore(lease.ExpiresAt),
+		lease.ID,
+	}
+	for i, check := range checks {
+		redisKeys[i], redisKeys[len(checks)+i] = s.redisKeys(check.Key)
+		redisKeys[2*len(checks)+i] = s.redisBlockedKey(check.Key)
+		args = append(args, strconv.FormatFloat(check.Margin.Percent, 'f', -1, 64), strconv.Itoa(check.Margin.Count), strconv.Itoa(check.Held), redisHeldInWindow(check))
+	}
+
+	// Without an answer from redis, back off for a second instead of letting callers spin
+	reply, err := s.eval(redisCheckAndReserveScript, redisKeys, args...)
+	if err != nil {
+		return time.Second, false
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		s.reportError(errors.New("unexpected reply from redis check and reserve script"))
+		return time.Second, false
+	}
+
+	reserved, _ := values[0].(int64)
+	waitTime, _ := values[1].(int64)
+	return time.Duration(waitTime), reserved == 1
+}
+
+// Closes every idle connection
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case conn := <-s.pool:
+			conn.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Runs a Lua script with EVALSHA, falling back to EVAL if the server doesn't have it cached yet
+func (s *RedisStore) eval(script *redisScript, keys []string, args ...string) (any, error) {
+	command := []string{"EVALSHA", script.sha, strconv.Itoa(len(keys))}
+	command = append(command, keys...)
+	command = append(command, args...)
+
+	reply, err := s.doQuiet(command...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		command[0], command[1] = "EVAL", script.source
+		reply, err = s.doQuiet(command...)
+	}
+
+	if err != nil {
+		s.reportError(err)
+	}
+	return reply, err
+}
+
+// Sends a command to redis and reports any error
+func (s *RedisStore) do(args ...string) (any, error) {
+	reply, err := s.doQuiet(args...)
+	if err != nil {
+		s.reportError(err)
+	}
+	return reply, err
+}
+
+// Sends a command to redis and returns the reply
+func (s *RedisStore) doQuiet(args ...string) (any, error) {
+	conn, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(s.options.Timeout, args...)
+	if err != nil {
+		var replyErr redisError
+		if !errors.As(err, &replyErr) {
+			// Protocol or network errors leave the connection in an unknown state
+			conn.conn.Close()
+			return nil, err
+		}
+	}
+
+	s.putConn(conn)
+	return reply, err
+}
+
+// Takes an idle connection from the pool or dials a new one
+func (s *RedisStore) getConn() (*redisConn, error) {
+	select {
+	case conn := <-s.pool:
+		return conn, nil
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", s.options.Addr, s.options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &redisConn{
+		conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		writer: bufio.NewWriter(netConn),
+	}
+
+	if s.options.Password != "" {
+		if _, err := conn.do(s.options.Timeout, "AUTH", s.options.Password); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+
+	if s.options.DB != 0 {
+		if _, err := conn.do(s.options.Timeout, "SELECT", strconv.Itoa(s.options.DB)); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// Returns a connection to the pool, closing it if the pool is full
+func (s *RedisStore) putConn(conn *redisConn) {
+	select {
+	case s.pool <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+func (s *RedisStore) reportError(err error) {
+	if s.options.OnError != nil {
+		s.options.OnError(err)
+	}
+}
+
+// An error reply sent by the redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// Writes a command in the RESP format and reads its reply
+func (c *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+
+	c.writer.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		c.writer.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+// Reads a single RESP reply
+// Simple and bulk strings become string, integers become int64, arrays become []any and nil replies become nil
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply from redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		values := make([]any, size)
+		for i := range values {
+			if values[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+
+	return nil, errors.New("unknown reply type from redis: " + line)
+}
+
+// Converts a ttl to whole milliseconds for PX, rounding up so short ttls don't become 0
+func redisMilliseconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
+// Returns the score of a lease expiring at the given time, in milliseconds
+func redisLeaseScore(expiresAt time.Time) string {
+	return strconv.FormatInt(expiresAt.UnixMilli(), 10)
+}
+
+// Decodes rate limits stored as a JSON array, returning nil if they are invalid
+func decodeRedisLimits(raw string) []RateLimits {
+	var encoded []redisRateLimits
+	if err := json.Unmarshal([]byte(raw), &encoded); err != nil {
+		return nil
+	}
+
+	limits := make([]RateLimits, 0, len(encoded))
+	for _, limit := range encoded {
+		rateLimits := RateLimits{
+			Limit:      limit.Limit,
+			Counts:     limit.Counts,
+			Duration:   time.Duration(limit.Duration),
+			RetryAfter: time.Duration(limit.RetryAfter),
+		}
+		if limit.LastAt != 0 {
+			rateLimits.LastAt = time.Unix(0, limit.LastAt)
+		}
+		if limit.WindowStart != 0 {
+			rateLimits.WindowStart = time.Unix(0, limit.WindowStart)
+		}
+		limits = append(limits, rateLimits)
+	}
+
+	return limits
+}
+
+// Encodes rate limits as a JSON array
+func encodeRedisLimits(limits []RateLimits) string {
+	encoded := make([]redisRateLimits, 0, len(limits))
+	for _, limit := range limits {
+		rateLimits := redisRateLimits{
+			Limit:      limit.Limit,
+			Counts:     limit.Counts,
+			Duration:   int64(limit.Duration),
+			RetryAfter: int64(limit.RetryAfter),
+		}
+		if !limit.LastAt.IsZero() {
+			rateLimits.LastAt = limit.LastAt.UnixNano()
+		}
+		if !limit.WindowStart.IsZero() {
+			rateLimits.WindowStart = limit.WindowStart.UnixNano()
+		}
+		encoded = append(encoded, rateLimits)
+	}
+
+	raw, _ := json.Marshal(encoded)
+	return string(raw)
+}
@@ -0,0 +1,327 @@
+package ratelimiter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts an in-process stand-in speaking just enough RESP for the plain key-value commands
+// Lua scripts need a real server, see newTestRedisStore
+func startFakeRedis(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	data := map[string]string{}
+	sets := map[string]map[string]int64{}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					args, err := readFakeRedisCommand(reader)
+					if err != nil {
+						return
+					}
+
+					mu.Lock()
+					reply := ""
+					switch strings.ToUpper(args[0]) {
+					case "SET":
+						data[args[1]] = args[2]
+						reply = "+OK\r\n"
+					case "GET":
+						if value, exists := data[args[1]]; exists {
+							reply = "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+						} else {
+							reply = "$-1\r\n"
+						}
+					case "MGET":
+						reply = "*" + strconv.Itoa(len(args)-1) + "\r\n"
+						for _, key := range args[1:] {
+							if value, exists := data[key]; exists {
+								reply += "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+							} else {
+								reply += "$-1\r\n"
+							}
+						}
+					case "EXISTS", "DEL":
+						count := 0
+						for _, key := range args[1:] {
+							_, exists := data[key]
+							_, setExists := sets[key]
+							if exists || setExists {
+								count++
+								if strings.ToUpper(args[0]) == "DEL" {
+									delete(data, key)
+									delete(sets, key)
+								}
+							}
+						}
+						reply = ":" + strconv.Itoa(count) + "\r\n"
+					case "ZADD":
+						if sets[args[1]] == nil {
+							sets[args[1]] = map[string]int64{}
+						}
+						for i := 2; i+1 < len(args); i += 2 {
+							sets[args[1]][args[i+1]], _ = strconv.ParseInt(args[i], 10, 64)
+						}
+						reply = ":" + strconv.Itoa((len(args)-2)/2) + "\r\n"
+					case "PEXPIRE":
+						reply = ":1\r\n"
+					case "ZRANGEBYSCORE":
+						// Only supports an exclusive minimum and +inf as the maximum, as used by Get
+						minimum, _ := strconv.ParseInt(strings.TrimPrefix(args[2], "("), 10, 64)
+						var values []string
+						for member, score := range sets[args[1]] {
+							if score > minimum {
+								values = append(values, member, strconv.FormatInt(score, 10))
+							}
+						}
+						reply = "*" + strconv.Itoa(len(values)) + "\r\n"
+						for _, value := range values {
+							reply += "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+						}
+					default:
+						reply = "-ERR unknown command '" + args[0] + "'\r\n"
+					}
+					mu.Unlock()
+
+					if _, err := io.WriteString(conn, reply); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+// Starts a redis-server on a free port for the duration of the test, skipping the test if it isn't installed
+func startRedisServer(t *testing.T) string {
+	path, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redis-server not installed, skipping test against a real redis server")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	server := exec.Command(path, "--bind", "127.0.0.1", "--port", port, "--save", "", "--appendonly", "no")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start redis-server: %v", err)
+	}
+	t.Cleanup(func() {
+		server.Process.Kill()
+		server.Wait()
+	})
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("redis-server didn't start listening: %v", err)
+		}
+	}
+}
+
+// Connects to the redis server at REDIS_ADDR, or to a redis-server started for the test if it isn't set
+func newTestRedisStore(t *testing.T) *RedisStore {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = startRedisServer(t)
+	}
+
+	store := NewRedisStore(RedisOptions{
+		Addr:    addr,
+		Prefix:  "ratelimiter-test:" + strconv.FormatInt(time.Now().UnixNano(), 10) + ":",
+		OnError: func(err error) { t.Errorf("Unexpected redis error: %v", err) },
+	})
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRedisStoreKeyValue(t *testing.T) {
+	store := NewRedisStore(RedisOptions{Addr: startFakeRedis(t)})
+	defer store.Close()
+
+	limits := []RateLimits{{Limit: 100, Counts: 5, Duration: 120 * time.Second, LastAt: time.Unix(0, 1700000000123456789)}}
+	store.Set(testAppKey, BucketState{Limits: limits, Leases: testLeases(3, time.Minute)}, 0)
+	store.Set(testMethodKey, BucketState{Leases: append(testLeases(2, time.Minute), testLeases(1, -time.Minute)...)}, 0)
+
+	state, exists := store.Get(testAppKey)
+	if !exists {
+		t.Fatalf("Expected the application bucket to exist")
+	}
+	if !limitsEqual(state.Limits, limits) || state.Reserved() != 3 {
+		t.Errorf("Expected %v with 3 reservations, got %v", limits, state)
+	}
+
+	if state, _ := store.Get(testMethodKey); len(state.Limits) != 0 || state.Reserved() != 2 {
+		t.Errorf("Expected only the 2 active reservations, got %v", state)
+	}
+
+	if !store.Has(testMethodKey) || !store.Remove(testMethodKey) || store.Has(testMethodKey) {
+		t.Errorf("Expected the method bucket to exist once and then be removed")
+	}
+
+	if _, exists := store.Get(BucketKey{Platform: "EUW1", Scope: LIMIT_TYPE_APPLICATION}); exists {
+		t.Errorf("Expected missing bucket to not exist")
+	}
+}
+
+func TestRedisStoreScripts(t *testing.T) {
+	store := newTestRedisStore(t)
+
+	for _, lease := range testLeases(3, time.Minute) {
+		store.AddLease(testAppKey, lease)
+	}
+	expired := newLease(time.Now().Add(-time.Second))
+	if count := store.AddLease(testAppKey, expired); count != 3 {
+		t.Errorf("Expected 3 active leases, got %d", count)
+	}
+	if count := store.RemoveLeasesN(testAppKey, -1); count != 3 {
+		t.Errorf("Expected a negative count to remove nothing, got %d", count)
+	}
+	if count := store.RemoveLeasesN(testAppKey, 5); count != 0 {
+		t.Errorf("Expected reservations to stop at 0, got %d", count)
+	}
+	if reclaimed := store.ReclaimLeases(testAppKey, time.Now()); reclaimed != 1 {
+		t.Errorf("Expected the expired lease to be reclaimed, got %d", reclaimed)
+	}
+
+	first := []RateLimits{{Limit: 1, Counts: 0, Duration: time.Minute, LastAt: time.Now()}}
+	second := []RateLimits{{Limit: 1, Counts: 1, Duration: time.Minute, LastAt: time.Now()}}
+	if !store.CompareAndSwapLimits(testMethodKey, nil, first, time.Minute) {
+		t.Fatalf("Expected swap on a bucket without limits to succeed")
+	}
+	if store.CompareAndSwapLimits(testMethodKey, nil, second, time.Minute) {
+		t.Errorf("Expected swap with a stale old value to fail")
+	}
+
+	current, _ := store.Get(testMethodKey)
+	if !store.CompareAndSwapLimits(testMethodKey, current.Limits, first, time.Minute) {
+		t.Errorf("Expected swap with the current value to succeed")
+	}
+
+	checks := []BucketCheck{{Key: testAppKey}, {Key: testMethodKey}}
+	if _, reserved := store.CheckAndReserve(checks, newLease(time.Now().Add(time.Minute)), time.Now()); !reserved {
+		t.Errorf("Expected the first reservation to succeed")
+	}
+	if wait, reserved := store.CheckAndReserve(checks, newLease(time.Now().Add(time.Minute)), time.Now()); reserved || wait <= 0 {
+		t.Errorf("Expected the second reservation to wait, got %v and %v", wait, reserved)
+	}
+	if state, _ := store.Get(testAppKey); state.Reserved() != 1 {
+		t.Errorf("Expected 1 reservation on the application bucket, got %d", state.Reserved())
+	}
+
+	_, leasesKey := store.redisKeys(testAppKey)
+	reply, _ := store.do("PTTL", leasesKey)
+	if ttl, _ := reply.(int64); ttl <= 0 || ttl > time.Minute.Milliseconds() {
+		t.Errorf("Expected the leases to expire with the latest of them, got a ttl of %v", reply)
+	}
+}
+
+func TestRedisStoreRateLimiter(t *testing.T) {
+	store := newTestRedisStore(t)
+	rl := NewRateLimiter(store)
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 3, Counts: 0, Duration: time.Minute, LastAt: time.Now()},
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, wait, err := rl.TryReserve(testUrl, "GET"); err != nil || wait != 0 {
+			t.Fatalf("Expected reservation %d to succeed, got %v and %v", i+1, wait, err)
+		}
+	}
+	reservation, wait, err := rl.TryReserve(testUrl, "GET")
+	if err != nil || reservation != nil || wait <= 0 {
+		t.Errorf("Expected the fourth reservation to wait, got %v, %v and %v", reservation, wait, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := rl.Wait(ctx, testUrl, "GET", LIMIT_STRATEGY_BURST); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Wait to run out of time on a full window, got %v", err)
+	}
+
+	if state, _ := store.Get(testAppKey); state.Reserved() != 3 {
+		t.Errorf("Expected the 3 admitted requests to hold reservations, got %d", state.Reserved())
+	}
+}
+
+func TestRedisStoreRateLimiterWait(t *testing.T) {
+	store := newTestRedisStore(t)
+	rl := NewRateLimiter(store)
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 2, Counts: 2, Duration: time.Second, LastAt: time.Now()},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	reservation, err := rl.Wait(ctx, testUrl, "GET", LIMIT_STRATEGY_BURST)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Errorf("Expected Wait to hold the request until the window reset, waited %v", waited)
+	}
+
+	reservation.Cancel()
+	if state, _ := store.Get(testAppKey); state.Reserved() != 0 {
+		t.Errorf("Expected the reservation to be released, got %d", state.Reserved())
+	}
+}
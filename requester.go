@@ -0,0 +1,94 @@
+package ratelimiter
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"time"
+)
+
+// Requester makes requests with more details than a URL and method, such as a tenant or labels
+// Create one with RateLimiter.Tenant or RateLimiter.Requester
+type Requester struct {
+	rl     *RateLimiter
+	tenant string
+	labels map[string]string
+}
+
+// Requester returns a Requester making requests with the given labels, for the levels added with LabelLevel
+// e.g. rl.Requester(map[string]string{"user": userID}) with LabelLevel("user", perUserLimits) limits every end user on its own
+func (rl *RateLimiter) Requester(labels map[string]string) *Requester {
+	return &Requester{rl: rl, labels: maps.Clone(labels)}
+}
+
+// WithLabels returns a copy of the handle that adds the given labels to its requests
+func (r *Requester) WithLabels(labels map[string]string) *Requester {
+	merged := maps.Clone(r.labels)
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	maps.Copy(merged, labels)
+	return &Requester{rl: r.rl, tenant: r.tenant, labels: merged}
+}
+
+// Returns the details of a request made through the handle
+func (r *Requester) details(url string, method string) (*RateLimitDetails, error) {
+	details, err := urlHelper(url, method)
+	if err != nil {
+		return nil, err
+	}
+	details.TenantName, details.Labels = r.tenant, r.labels
+	return details, nil
+}
+
+// GetWaitFor is like RateLimiter.GetWaitFor, for a request made through the handle
+func (r *Requester) GetWaitFor(url string, method string, strategy LimitStrategy) (time.Duration, error) {
+	details, err := r.details(url, method)
+	if err != nil {
+		return 0, err
+	}
+	return r.rl.getWaitFor(details, strategy)
+}
+
+// Reserve is like RateLimiter.Reserve, for a request made through the handle
+func (r *Requester) Reserve(url string, method string) (*Reservation, error) {
+	details, err := r.details(url, method)
+	if err != nil {
+		return nil, err
+	}
+	return r.rl.reserve(details), nil
+}
+
+// TryReserve is like RateLimiter.TryReservePriority, for a request made through the handle
+func (r *Requester) TryReserve(url string, method string, priority Priority) (*Reservation, time.Duration, error) {
+	details, err := r.details(url, method)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r.rl.tryReserve(details, priority)
+}
+
+// Wait is like RateLimiter.WaitPriority, for a request made through the handle
+func (r *Requester) Wait(ctx context.Context, url string, method string, strategy LimitStrategy, priority Priority) (*Reservation, error) {
+	details, err := r.details(url, method)
+	if err != nil {
+		return nil, err
+	}
+	return r.rl.wait(ctx, details, strategy, priority)
+}
+
+// UpdateFromHeaders is like RateLimiter.UpdateFromHeaders, for a request made through the handle
+func (r *Requester) UpdateFromHeaders(url string, method string, headers http.Header) error {
+	details, err := r.details(url, method)
+	if err != nil {
+		return err
+	}
+	return r.rl.updateFromHeaders(details, headers)
+}
+
+// Usage returns the accounting of the tenant of the handle, see RateLimiter.TenantUsage
+// It is empty if the handle has no tenant
+func (r *Requester) Usage() TenantUsage {
+	usage, _ := r.rl.TenantUsage(r.tenant)
+	return usage
+}
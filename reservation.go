@@ -0,0 +1,74 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Reservation is a slot claimed for a single request
+// It must be finished with either Complete or Cancel, both of which are safe to call more than once and on a nil Reservation
+// If it is never finished, its lease expires and the slot is reclaimed
+type Reservation struct {
+	rl       *RateLimiter
+	details  *RateLimitDetails
+	lease    Lease
+	finished atomic.Bool
+	// Unix nanoseconds the request was sent at
+	sentAt atomic.Int64
+}
+
+// Creates a Reservation for a slot that was already claimed in the store
+func newReservation(rl *RateLimiter, details *RateLimitDetails, lease Lease) *Reservation {
+	r := &Reservation{rl: rl, details: details, lease: lease}
+	r.sentAt.Store(rl.now().UnixNano())
+	return r
+}
+
+// MarkSent records that the request is being sent now, call it right before sending
+// The limits learned from the response are stamped with this time, which defaults to when the reservation was made
+func (r *Reservation) MarkSent() {
+	if r == nil {
+		return
+	}
+	r.sentAt.Store(r.rl.now().UnixNano())
+}
+
+// Returns the time the request was sent
+func (r *Reservation) sentTime() time.Time {
+	return time.Unix(0, r.sentAt.Load())
+}
+
+// ExpiresAt returns when the lease of the reservation expires
+func (r *Reservation) ExpiresAt() time.Time {
+	return r.lease.ExpiresAt
+}
+
+// Complete updates the rate limits from the response headers and releases the slot
+// Only the first call to Complete or Cancel has any effect, later calls and calls on a nil Reservation return nil
+func (r *Reservation) Complete(headers http.Header) error {
+	if r == nil || !r.finished.CompareAndSwap(false, true) {
+		return nil
+	}
+	r.rl.releaseLease(r.details, r.lease.ID)
+	return r.rl.updateFromResponse(r.details, 0, headers, r.sentTime())
+}
+
+// CompleteResponse is like Complete, but also uses the status code of the response
+// This catches service 429s that come without any headers
+func (r *Reservation) CompleteResponse(resp *http.Response) error {
+	if r == nil || !r.finished.CompareAndSwap(false, true) {
+		return nil
+	}
+	r.rl.releaseLease(r.details, r.lease.ID)
+	return r.rl.updateFromResponse(r.details, resp.StatusCode, resp.Header, r.sentTime())
+}
+
+// Cancel releases the slot without updating the rate limits, e.g. when the request failed without a response
+// Only the first call to Complete or Cancel has any effect, so it is safe to defer, even before checking the error of Reserve
+func (r *Reservation) Cancel() {
+	if r == nil || !r.finished.CompareAndSwap(false, true) {
+		return
+	}
+	r.rl.releaseLease(r.details, r.lease.ID)
+}
@@ -0,0 +1,68 @@
+package ratelimiter
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Consecutive service 429s seen for a service bucket
+type serviceBackoff struct {
+	mu      sync.Mutex
+	strikes int
+}
+
+// Returns the backoff state of a service bucket, creating it if needed
+func (rl *RateLimiter) serviceBackoff(key BucketKey) *serviceBackoff {
+	backoff, _ := rl.backoffs.LoadOrStore(key, &serviceBackoff{})
+	return backoff.(*serviceBackoff)
+}
+
+// Records a service 429 and blocks the service for its backoff, or for the Retry-After if that is longer
+func (rl *RateLimiter) backOffService(details *RateLimitDetails, retryAfter time.Duration, now time.Time) {
+	key := details.bucketKey(LIMIT_TYPE_SERVICE)
+	backoff := rl.serviceBackoff(key)
+
+	backoff.mu.Lock()
+	backoff.strikes++
+	wait := serviceBackoffDuration(backoff.strikes)
+	backoff.mu.Unlock()
+
+	until := now.Add(max(wait, retryAfter))
+	rl.track(key)
+	rl.cache.Block(key, until)
+	if rl.hooks.OnBlocked != nil {
+		rl.hooks.OnBlocked(key, until)
+	}
+}
+
+// Decays the backoff of the service of a request after a successful response
+func (rl *RateLimiter) recoverService(details *RateLimitDetails) {
+	backoff, exists := rl.backoffs.Load(details.bucketKey(LIMIT_TYPE_SERVICE))
+	if !exists {
+		return
+	}
+
+	state := backoff.(*serviceBackoff)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.strikes = max(state.strikes-1, 0)
+}
+
+// Returns how long the service of a request is still blocked
+func (rl *RateLimiter) serviceWait(details *RateLimitDetails, now time.Time) time.Duration {
+	state, _ := rl.cache.Get(details.bucketKey(LIMIT_TYPE_SERVICE))
+	return state.blockWait(now)
+}
+
+// Calculates the backoff after the given number of consecutive service 429s
+// It doubles with every strike up to SERVICE_BACKOFF_MAX, and a random half of it is jitter so clients don't retry in lockstep
+func serviceBackoffDuration(strikes int) time.Duration {
+	backoff := SERVICE_BACKOFF_BASE
+	for i := 1; i < strikes && backoff < SERVICE_BACKOFF_MAX; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, SERVICE_BACKOFF_MAX)
+
+	return backoff/2 + rand.N(backoff/2+1)
+}
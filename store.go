@@ -1,51 +1,432 @@
 package ratelimiter
 
+import (
+	"hash/maphash"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store is the storage backend used by the RateLimiter
+// Implement this interface to keep the rate limit state somewhere other than local memory
+// Implementations must be safe for concurrent use
+type Store interface {
+	// Stores the state of a bucket, with its limits expiring after ttl (a ttl of 0 never expires)
+	Set(key BucketKey, state BucketState, ttl time.Duration)
+	// Retrieves the state of a bucket, along with a boolean indicating if the bucket was found
+	Get(key BucketKey) (BucketState, bool)
+	// Checks if a bucket exists
+	Has(key BucketKey) bool
+	// Removes a bucket, returns true if the bucket was found and removed
+	Remove(key BucketKey) bool
+	// Atomically blocks a bucket until the given time, unless it is already blocked for longer
+	Block(key BucketKey, until time.Time)
+	// Atomically adds a lease to a bucket and returns the number of leases it holds
+	AddLease(key BucketKey, lease Lease) int
+	// Atomically removes a lease from a bucket, returns true if the bucket held it
+	RemoveLease(key BucketKey, id string) bool
+	// Atomically removes the n leases of a bucket that expire soonest and returns the number of leases left
+	// An n of 0 or less removes nothing
+	RemoveLeasesN(key BucketKey, n int) int
+	// Atomically removes the leases of a bucket that expired by the given time and returns how many were removed
+	// Expired leases never count as reservations, this only frees them
+	ReclaimLeases(key BucketKey, now time.Time) int
+	// Atomically replaces the limits of a bucket with new, but only if they currently equal old
+	// An empty old matches a bucket without limits, the reservations are left untouched
+	// The new limits expire after ttl (a ttl of 0 never expires)
+	// Returns true if the swap happened
+	CompareAndSwapLimits(key BucketKey, old []RateLimits, new []RateLimits, ttl time.Duration) bool
+	// Atomically checks that every bucket is unblocked and has room for one more request on top of its reservations at the given time
+	// The room is measured against each limit with the safety margin and the held requests of the check taken off
+	// If they all do, the lease is added to all of them and (0, true) is returned
+	// Otherwise nothing changes and the time to wait before trying again is returned with false
+	CheckAndReserve(checks []BucketCheck, lease Lease, now time.Time) (time.Duration, bool)
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// Number of shards used by the MemoryStore
+const storeShardCount = 32
+
+// A bucket in the MemoryStore along with the expiry time of its limits (zero if they never expire)
+type storeEntry struct {
+	state     BucketState
+	expiresAt time.Time
+}
+
+type storeShard struct {
+	mu   sync.RWMutex
+	data map[BucketKey]storeEntry
+}
+
 // Implements basic Cache/Map behavior
-type Store struct {
-	data map[string]any
+// This is the default Store implementation, keeping everything in local memory
+// Keys are spread over several shards, each guarded by its own RWMutex
+// Expired limits are ignored as soon as they expire and removed by the janitor, if one is running
+type MemoryStore struct {
+	seed   maphash.Seed
+	shards [storeShardCount]*storeShard
+	clock  Clock
+
+	leaseReclaimed atomic.Pointer[func(key BucketKey, n int)]
+
+	janitorMu   sync.Mutex
+	janitorStop chan struct{}
+	janitorDone chan struct{}
+}
+
+// Creates a new MemoryStore instance
+func NewStore() *MemoryStore {
+	return NewStoreWithClock(systemClock{})
+}
+
+// Creates a new MemoryStore instance that expires limits, blocks and leases by the given clock
+// The janitor still runs on the system time, call DeleteExpired to clean up after advancing a FakeClock
+func NewStoreWithClock(clock Clock) *MemoryStore {
+	s := &MemoryStore{seed: maphash.MakeSeed(), clock: clock}
+	for i := range s.shards {
+		s.shards[i] = &storeShard{data: make(map[BucketKey]storeEntry)}
+	}
+	return s
+}
+
+// Returns the index of the shard responsible for a key
+func (s *MemoryStore) shardIndex(key BucketKey) int {
+	return int(maphash.Comparable(s.seed, key) % storeShardCount)
+}
+
+// Returns the shard responsible for a key
+func (s *MemoryStore) shard(key BucketKey) *storeShard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// Returns the expiry time for a ttl, or the zero time if the ttl is 0
+func expiryFor(ttl time.Duration, now time.Time) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
 }
 
-// Creates a new Store instance
-func NewStore() *Store {
-	return &Store{
-		data: make(map[string]any),
+// Returns the entry with its limits and block dropped if they have expired at the given time
+// Expired leases are kept until they are reclaimed
+func (e storeEntry) at(now time.Time) storeEntry {
+	if !e.expiresAt.IsZero() && !now.Before(e.expiresAt) {
+		e = storeEntry{state: BucketState{Leases: e.state.Leases, BlockedUntil: e.state.BlockedUntil}}
+	}
+	if !now.Before(e.state.BlockedUntil) {
+		e.state.BlockedUntil = time.Time{}
 	}
+	return e
 }
 
-// Stores a key-value pair in the store
-func (s *Store) Set(key string, value any) {
-	s.data[key] = value
+// Checks if the entry holds neither limits, leases nor a block
+func (e storeEntry) empty() bool {
+	return len(e.state.Limits) == 0 && len(e.state.Leases) == 0 && e.state.BlockedUntil.IsZero()
+}
+
+// Returns a copy of the leases that are still active at the given time
+func activeLeases(leases []Lease, now time.Time) []Lease {
+	var active []Lease
+	for _, lease := range leases {
+		if !lease.expired(now) {
+			active = append(active, lease)
+		}
+	}
+	return active
 }
 
-// Retrieves a value by key from the store
-// Returns the value and a boolean indicating if the key was found
-func (s *Store) Get(key string) (any, bool) {
-	value, exists := s.data[key]
-	return value, exists
+// Returns the entry stored at key as of the given time
+// The shard lock must be held by the caller
+func (sh *storeShard) get(key BucketKey, now time.Time) (storeEntry, bool) {
+	entry, exists := sh.data[key]
+	if !exists {
+		return storeEntry{}, false
+	}
+
+	entry = entry.at(now)
+	return entry, !entry.empty()
+}
+
+// Stores the entry at key, removing the key instead if the entry is empty
+// The shard lock must be held by the caller
+func (sh *storeShard) put(key BucketKey, entry storeEntry) {
+	if entry.empty() {
+		delete(sh.data, key)
+		return
+	}
+	sh.data[key] = entry
 }
 
-// Checks if a key exists in the store
-func (s *Store) Has(key string) bool {
-	_, exists := s.data[key]
+// Stores the state of a bucket, with its limits expiring after ttl (a ttl of 0 never expires)
+func (s *MemoryStore) Set(key BucketKey, state BucketState, ttl time.Duration) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	now := s.clock.Now()
+	state.Leases = activeLeases(state.Leases, now)
+	shard.put(key, storeEntry{state: state, expiresAt: expiryFor(ttl, now)}.at(now))
+}
+
+// Retrieves the state of a bucket from the store, leaving out expired leases
+// Returns the state and a boolean indicating if the bucket was found
+func (s *MemoryStore) Get(key BucketKey) (BucketState, bool) {
+	shard := s.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	now := s.clock.Now()
+	entry, _ := shard.get(key, now)
+	state := entry.state
+	state.Leases = activeLeases(state.Leases, now)
+	return state, len(state.Limits) > 0 || len(state.Leases) > 0 || !state.BlockedUntil.IsZero()
+}
+
+// Checks if a bucket exists in the store
+func (s *MemoryStore) Has(key BucketKey) bool {
+	_, exists := s.Get(key)
+	return exists
+}
+
+// Removes a bucket from the store
+// Returns true if the bucket was found and removed, false otherwise
+func (s *MemoryStore) Remove(key BucketKey) bool {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	_, exists := shard.get(key, s.clock.Now())
+	delete(shard.data, key)
 	return exists
 }
 
-// Removes a key-value pair from the store
-// Returns true if the key was found and removed, false otherwise
-func (s *Store) Remove(key string) bool {
-	if _, exists := s.data[key]; exists {
-		delete(s.data, key)
-		return true
+// Atomically blocks a bucket until the given time, unless it is already blocked for longer
+func (s *MemoryStore) Block(key BucketKey, until time.Time) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	now := s.clock.Now()
+	entry, _ := shard.get(key, now)
+	if until.After(entry.state.BlockedUntil) {
+		entry.state.BlockedUntil = until
+		shard.put(key, entry.at(now))
 	}
-	return false
 }
 
-// Returns the number of key-value pairs in the store
-func (s *Store) Size() int {
-	return len(s.data)
+// Atomically adds a lease to a bucket and returns the number of leases it holds
+func (s *MemoryStore) AddLease(key BucketKey, lease Lease) int {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	now := s.clock.Now()
+	entry, _ := shard.get(key, now)
+	entry.state.Leases = append(entry.state.Leases, lease)
+	shard.put(key, entry)
+	return len(activeLeases(entry.state.Leases, now))
+}
+
+// Atomically removes a lease from a bucket, returns true if the bucket held it
+func (s *MemoryStore) RemoveLease(key BucketKey, id string) bool {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, _ := shard.get(key, s.clock.Now())
+	index := slices.IndexFunc(entry.state.Leases, func(lease Lease) bool { return lease.ID == id })
+	if index < 0 {
+		return false
+	}
+	entry.state.Leases = slices.Delete(entry.state.Leases, index, index+1)
+	shard.put(key, entry)
+	return true
 }
 
-// Clears all key-value pairs from the store
-func (s *Store) Clear() {
-	s.data = make(map[string]any)
+// Atomically removes the n leases of a bucket that expire soonest and returns the number of leases left
+func (s *MemoryStore) RemoveLeasesN(key BucketKey, n int) int {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	now := s.clock.Now()
+	entry, _ := shard.get(key, now)
+	// Expired leases sort first and are kept, so they are still reported when reclaimed
+	leases := slices.SortedFunc(slices.Values(entry.state.Leases), func(a Lease, b Lease) int {
+		return a.ExpiresAt.Compare(b.ExpiresAt)
+	})
+	start := slices.IndexFunc(leases, func(lease Lease) bool { return !lease.expired(now) })
+	if start < 0 {
+		return 0
+	}
+	entry.state.Leases = slices.Delete(leases, start, start+min(max(n, 0), len(leases)-start))
+	shard.put(key, entry)
+	return len(entry.state.Leases) - start
+}
+
+// Atomically removes the leases of a bucket that expired by the given time and returns how many were removed
+func (s *MemoryStore) ReclaimLeases(key BucketKey, now time.Time) int {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, _ := shard.get(key, now)
+	active := activeLeases(entry.state.Leases, now)
+	reclaimed := len(entry.state.Leases) - len(active)
+	if reclaimed > 0 {
+		entry.state.Leases = active
+		shard.put(key, entry)
+	}
+	return reclaimed
+}
+
+// Atomically replaces the limits of a bucket with new if they currently equal old
+func (s *MemoryStore) CompareAndSwapLimits(key BucketKey, old []RateLimits, new []RateLimits, ttl time.Duration) bool {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	now := s.clock.Now()
+	entry, _ := shard.get(key, now)
+	if !limitsEqual(entry.state.Limits, old) {
+		return false
+	}
+	entry.state.Limits = new
+	entry.expiresAt = expiryFor(ttl, now)
+	shard.put(key, entry)
+	return true
+}
+
+// Atomically checks every bucket against its limits and reservations and adds the lease to all of them if possible
+func (s *MemoryStore) CheckAndReserve(checks []BucketCheck, lease Lease, now time.Time) (time.Duration, bool) {
+	// Lock every shard involved, always in the same order to avoid deadlocks
+	var indexes []int
+	for _, check := range checks {
+		indexes = append(indexes, s.shardIndex(check.Key))
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+	for _, index := range indexes {
+		s.shards[index].mu.Lock()
+		defer s.shards[index].mu.Unlock()
+	}
+
+	waitTime := time.Duration(0)
+	for _, check := range checks {
+		entry, _ := s.shard(check.Key).get(check.Key, now)
+		reserved := len(activeLeases(entry.state.Leases, now))
+		waitTime = max(waitTime, entry.state.blockWait(now))
+		for _, limit := range entry.state.Limits {
+			waitTime = max(waitTime, burstWait([]RateLimits{limit}, reserved+check.held(limit), check.Margin, now))
+		}
+	}
+
+	if waitTime > 0 {
+		return waitTime, false
+	}
+
+	for _, check := range checks {
+		shard := s.shard(check.Key)
+		entry, _ := shard.get(check.Key, now)
+		entry.state.Leases = append(entry.state.Leases, lease)
+		shard.put(check.Key, entry)
+	}
+
+	return 0, true
+}
+
+// Returns the number of buckets in the store, not counting those with nothing but expired limits
+func (s *MemoryStore) Size() int {
+	now := s.clock.Now()
+	size := 0
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for _, entry := range shard.data {
+			if !entry.at(now).empty() {
+				size++
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	return size
+}
+
+// Clears all buckets from the store
+func (s *MemoryStore) Clear() {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		shard.data = make(map[BucketKey]storeEntry)
+		shard.mu.Unlock()
+	}
+}
+
+// Drops every expired limit, block and lease, removing buckets that are left empty
+// The expired leases are reported to the OnLeaseReclaimed callback, so leases of buckets that are never used again are still freed
+func (s *MemoryStore) DeleteExpired() {
+	now := s.clock.Now()
+	reclaimed := make(map[BucketKey]int)
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		for key, entry := range shard.data {
+			entry = entry.at(now)
+			if active := activeLeases(entry.state.Leases, now); len(active) < len(entry.state.Leases) {
+				reclaimed[key] = len(entry.state.Leases) - len(active)
+				entry.state.Leases = active
+			}
+			shard.put(key, entry)
+		}
+		shard.mu.Unlock()
+	}
+
+	if callback := s.leaseReclaimed.Load(); callback != nil {
+		for key, n := range reclaimed {
+			(*callback)(key, n)
+		}
+	}
+}
+
+// OnLeaseReclaimed sets a callback run whenever DeleteExpired reclaims expired leases from a bucket
+// n is the number of leases reclaimed, pass nil to remove the callback
+// NewRateLimiter sets it to report them like the leases the limiter reclaims itself
+func (s *MemoryStore) OnLeaseReclaimed(callback func(key BucketKey, n int)) {
+	if callback == nil {
+		s.leaseReclaimed.Store(nil)
+		return
+	}
+	s.leaseReclaimed.Store(&callback)
+}
+
+// Starts a background janitor removing expired entries every interval
+// Does nothing if a janitor is already running, stop it with Close
+func (s *MemoryStore) StartJanitor(interval time.Duration) {
+	s.janitorMu.Lock()
+	defer s.janitorMu.Unlock()
+	if s.janitorStop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	s.janitorStop, s.janitorDone = stop, done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.DeleteExpired()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the janitor, if one is running, and waits for it to exit
+func (s *MemoryStore) Close() error {
+	s.janitorMu.Lock()
+	defer s.janitorMu.Unlock()
+	if s.janitorStop == nil {
+		return nil
+	}
+
+	close(s.janitorStop)
+	<-s.janitorDone
+	s.janitorStop, s.janitorDone = nil, nil
+	return nil
 }
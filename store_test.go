@@ -0,0 +1,245 @@
+package ratelimiter
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testAppKey     = BucketKey{Platform: "NA1", Scope: LIMIT_TYPE_APPLICATION}
+	testMethodKey  = BucketKey{Platform: "NA1", Service: "SUMMONER", Method: "GET_BY_ACCESS_TOKEN", Scope: LIMIT_TYPE_METHOD}
+	testServiceKey = BucketKey{Platform: "NA1", Service: "SUMMONER", Scope: LIMIT_TYPE_SERVICE}
+)
+
+// Creates n leases expiring after ttl
+func testLeases(n int, ttl time.Duration) []Lease {
+	leases := make([]Lease, n)
+	for i := range leases {
+		leases[i] = newLease(time.Now().Add(ttl))
+	}
+	return leases
+}
+
+func TestMemoryStoreConcurrentAccess(t *testing.T) {
+	store := NewStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := BucketKey{Platform: "P" + strconv.Itoa(i%20), Scope: LIMIT_TYPE_APPLICATION}
+			store.Set(key, BucketState{Leases: testLeases(i%3+1, time.Minute)}, 0)
+			store.Get(key)
+			store.Has(key)
+			if i%7 == 0 {
+				store.Remove(key)
+			}
+			store.Size()
+		}(i)
+	}
+	wg.Wait()
+
+	if store.Size() > 20 {
+		t.Errorf("Expected at most 20 buckets, got %d", store.Size())
+	}
+
+	store.Clear()
+	if store.Size() != 0 {
+		t.Errorf("Expected empty store after Clear, got %d buckets", store.Size())
+	}
+}
+
+func TestMemoryStoreReservations(t *testing.T) {
+	store := NewStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			leases := testLeases(2, time.Minute)
+			store.AddLease(testAppKey, leases[0])
+			store.AddLease(testAppKey, leases[1])
+			if !store.RemoveLease(testAppKey, leases[0].ID) {
+				t.Errorf("Expected the lease to be removed")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if state, _ := store.Get(testAppKey); state.Reserved() != 300 {
+		t.Errorf("Expected 300 reservations, got %d", state.Reserved())
+	}
+
+	for _, n := range []int{0, -1} {
+		if value := store.RemoveLeasesN(testAppKey, n); value != 300 {
+			t.Errorf("Expected removing %d reservations to keep all 300, got %d", n, value)
+		}
+	}
+
+	if value := store.RemoveLeasesN(testAppKey, 1000); value != 0 {
+		t.Errorf("Expected reservations to stop at 0, got %d", value)
+	}
+
+	if store.Has(testAppKey) {
+		t.Errorf("Expected a bucket without limits or reservations to be removed")
+	}
+}
+
+func TestMemoryStoreCompareAndSwapLimits(t *testing.T) {
+	store := NewStore()
+	first := []RateLimits{{Limit: 100, Counts: 1, Duration: 120}}
+	second := []RateLimits{{Limit: 100, Counts: 2, Duration: 120}}
+
+	store.Set(testAppKey, BucketState{Leases: testLeases(3, time.Minute)}, 0)
+	if !store.CompareAndSwapLimits(testAppKey, nil, first, 0) {
+		t.Fatalf("Expected swap on a bucket without limits to succeed")
+	}
+
+	if store.CompareAndSwapLimits(testAppKey, nil, second, 0) {
+		t.Errorf("Expected swap with a stale old value to fail")
+	}
+
+	if !store.CompareAndSwapLimits(testAppKey, first, second, 0) {
+		t.Errorf("Expected swap with the current value to succeed")
+	}
+
+	state, _ := store.Get(testAppKey)
+	if !limitsEqual(state.Limits, second) || state.Reserved() != 3 {
+		t.Errorf("Expected %v with 3 reservations, got %v", second, state)
+	}
+}
+
+func TestMemoryStoreCheckAndReserve(t *testing.T) {
+	store := NewStore()
+	store.Set(testAppKey, BucketState{Limits: []RateLimits{{Limit: 10, Counts: 5, Duration: time.Minute, LastAt: time.Now()}}}, 0)
+	store.Set(testMethodKey, BucketState{Limits: []RateLimits{{Limit: 3, Counts: 1, Duration: time.Minute, LastAt: time.Now()}}}, 0)
+	checks := []BucketCheck{{Key: testAppKey}, {Key: testMethodKey}}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reservedCount := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, reserved := store.CheckAndReserve(checks, newLease(time.Now().Add(time.Minute)), time.Now()); reserved {
+				mu.Lock()
+				reservedCount++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reservedCount != 2 {
+		t.Errorf("Expected exactly 2 reservations to fit the method limit, got %d", reservedCount)
+	}
+
+	wait, reserved := store.CheckAndReserve(checks, newLease(time.Now().Add(time.Minute)), time.Now())
+	if reserved || wait <= 0 || wait > time.Minute {
+		t.Errorf("Expected to wait up to a minute, got %v and %v", wait, reserved)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
+	limits := []RateLimits{{Limit: 10, Duration: time.Minute}}
+	store.Set(testAppKey, BucketState{Limits: limits}, 20*time.Millisecond)
+	store.Set(testMethodKey, BucketState{Limits: limits, Leases: testLeases(1, time.Minute)}, 20*time.Millisecond)
+
+	if !store.Has(testAppKey) {
+		t.Fatalf("Expected short-lived bucket to exist before it expires")
+	}
+
+	clock.Advance(30 * time.Millisecond)
+
+	if store.Has(testAppKey) {
+		t.Errorf("Expected short-lived bucket to have expired")
+	}
+
+	state, exists := store.Get(testMethodKey)
+	if !exists || len(state.Limits) != 0 || state.Reserved() != 1 {
+		t.Errorf("Expected only the reservations to outlive the limits, got %v", state)
+	}
+
+	if size := store.Size(); size != 1 {
+		t.Errorf("Expected expired buckets to not be counted, got %d", size)
+	}
+}
+
+func TestMemoryStoreJanitor(t *testing.T) {
+	store := NewStore()
+	store.StartJanitor(5 * time.Millisecond)
+	defer store.Close()
+
+	store.Set(testAppKey, BucketState{Limits: []RateLimits{{Limit: 10}}}, time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+
+	shard := store.shard(testAppKey)
+	shard.mu.RLock()
+	_, exists := shard.data[testAppKey]
+	shard.mu.RUnlock()
+	if exists {
+		t.Errorf("Expected the janitor to remove the expired bucket")
+	}
+
+	if err := store.Close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestMemoryStoreDeleteExpiredLeases(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
+	store.AddLease(testAppKey, newLease(clock.Now().Add(time.Minute)))
+	store.AddLease(testAppKey, newLease(clock.Now().Add(time.Minute)))
+	store.AddLease(testMethodKey, newLease(clock.Now().Add(2*time.Hour)))
+
+	reclaimed := map[BucketKey]int{}
+	store.OnLeaseReclaimed(func(key BucketKey, n int) { reclaimed[key] += n })
+
+	clock.Advance(time.Hour)
+	store.DeleteExpired()
+
+	shard := store.shard(testAppKey)
+	shard.mu.RLock()
+	_, exists := shard.data[testAppKey]
+	shard.mu.RUnlock()
+	if exists {
+		t.Errorf("Expected a bucket holding only expired leases to be removed")
+	}
+	if state, _ := store.Get(testMethodKey); state.Reserved() != 1 {
+		t.Errorf("Expected active leases to be kept, got %d", state.Reserved())
+	}
+	if len(reclaimed) != 1 || reclaimed[testAppKey] != 2 {
+		t.Errorf("Expected the 2 expired leases to be reported, got %v", reclaimed)
+	}
+}
+
+func TestMemoryStoreBlock(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	store := NewStoreWithClock(clock)
+	until := time.Now().Add(time.Minute)
+	store.Block(testAppKey, until)
+	store.Block(testAppKey, time.Now().Add(time.Second))
+
+	if state, _ := store.Get(testAppKey); !state.BlockedUntil.Equal(until) {
+		t.Errorf("Expected a shorter block to leave the longer one alone, got %v", state.BlockedUntil)
+	}
+
+	wait, reserved := store.CheckAndReserve([]BucketCheck{{Key: testAppKey}}, newLease(time.Now().Add(time.Minute)), time.Now())
+	if reserved || wait < 59*time.Second {
+		t.Errorf("Expected to wait for the block, got %v and %v", wait, reserved)
+	}
+
+	store.Block(testMethodKey, clock.Now().Add(10*time.Millisecond))
+	clock.Advance(20 * time.Millisecond)
+	if store.Has(testMethodKey) {
+		t.Errorf("Expected a bucket with nothing but a lifted block to be empty")
+	}
+}
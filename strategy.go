@@ -0,0 +1,94 @@
+package ratelimiter
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Strategy decides how long a request waits for room in a bucket it passes through
+// limits are the limits of the bucket with its safety margin taken off, their Counts are the requests already sent in the current windows
+// reserved is the number of requests reserved on the bucket but not sent yet, and clock the clock of the limiter
+// A request waits for the longest wait returned for its buckets, on top of any 429 block or service backoff
+type Strategy interface {
+	Wait(limits []RateLimits, reserved int, clock Clock) time.Duration
+}
+
+// StrategyFunc lets a plain function be used as a Strategy
+type StrategyFunc func(limits []RateLimits, reserved int, clock Clock) time.Duration
+
+// Wait calls f
+func (f StrategyFunc) Wait(limits []RateLimits, reserved int, clock Clock) time.Duration {
+	return f(limits, reserved, clock)
+}
+
+// Registered strategies by name, see RegisterStrategy
+var (
+	strategiesMu sync.RWMutex
+	strategies   = map[LimitStrategy]Strategy{
+		LIMIT_STRATEGY_SPREAD: StrategyFunc(spreadStrategyWait),
+		LIMIT_STRATEGY_BURST:  StrategyFunc(burstStrategyWait),
+	}
+)
+
+// RegisterStrategy makes a strategy available under the given name to every limiter, e.g. for GetWaitFor, Wait or a Transport
+// Names can't be empty or registered twice, so the built-in spread and burst strategies can't be replaced
+func RegisterStrategy(name LimitStrategy, strategy Strategy) error {
+	if name == "" || strategy == nil {
+		return errors.New("strategy needs a name and an implementation")
+	}
+
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	if _, exists := strategies[name]; exists {
+		return errors.New("strategy already registered: " + string(name))
+	}
+	strategies[name] = strategy
+	return nil
+}
+
+// Returns the strategy registered under the given name, falling back to the default one of the limiter if none was given
+func (rl *RateLimiter) strategy(name LimitStrategy) (Strategy, error) {
+	if name == "" {
+		name = rl.defaultStrategy
+	}
+
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+	strategy, exists := strategies[name]
+	if !exists {
+		return nil, errors.New("unknown strategy: " + string(name))
+	}
+	return strategy, nil
+}
+
+// Waits until every full window resets, letting requests go as fast as the limits have room
+func burstStrategyWait(limits []RateLimits, reserved int, clock Clock) time.Duration {
+	now := clock.Now()
+	var waitTime time.Duration
+	for _, limit := range limits {
+		if limit.Counts+reserved >= limit.Limit {
+			waitTime = max(waitTime, limit.ResetAt().Sub(now))
+		}
+	}
+	return waitTime
+}
+
+// Waits until every full window resets, and otherwise spreads the requests left in each window evenly over the time until it resets
+func spreadStrategyWait(limits []RateLimits, reserved int, clock Clock) time.Duration {
+	now := clock.Now()
+	var waitTime time.Duration
+	for _, limit := range limits {
+		untilReset := limit.ResetAt().Sub(now)
+		if untilReset <= 0 {
+			continue
+		}
+
+		if remaining := limit.Limit - limit.Counts - reserved; remaining > 0 {
+			waitTime = max(waitTime, untilReset/time.Duration(remaining))
+		} else {
+			waitTime = max(waitTime, untilReset)
+		}
+	}
+	return waitTime
+}
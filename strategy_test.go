@@ -0,0 +1,84 @@
+package ratelimiter
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStrategies(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	limits := []RateLimits{{Limit: 10, Counts: 4, Duration: time.Minute, LastAt: clock.Now(), WindowStart: clock.Now()}}
+	full := []RateLimits{{Limit: 10, Counts: 10, Duration: time.Minute, LastAt: clock.Now(), WindowStart: clock.Now()}}
+
+	tests := []struct {
+		name     string
+		strategy LimitStrategy
+		limits   []RateLimits
+		reserved int
+		expected time.Duration
+	}{
+		{name: "Burst with room", strategy: LIMIT_STRATEGY_BURST, limits: limits, expected: 0},
+		{name: "Burst when full", strategy: LIMIT_STRATEGY_BURST, limits: full, expected: time.Minute},
+		{name: "Burst counts reservations", strategy: LIMIT_STRATEGY_BURST, limits: limits, reserved: 6, expected: time.Minute},
+		{name: "Spread with room", strategy: LIMIT_STRATEGY_SPREAD, limits: limits, reserved: 2, expected: 15 * time.Second},
+		{name: "Spread when full", strategy: LIMIT_STRATEGY_SPREAD, limits: full, expected: time.Minute},
+	}
+
+	rl := NewRateLimiter(NewStore(), WithClock(clock))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := rl.strategy(tt.strategy)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if wait := strategy.Wait(tt.limits, tt.reserved, clock); wait != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, wait)
+			}
+		})
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	rl := NewRateLimiter(NewStore())
+
+	if _, err := rl.GetWaitFor(testUrl, "GET", "unknown"); err == nil {
+		t.Errorf("Expected GetWaitFor to reject an unknown strategy")
+	}
+	if _, err := rl.Wait(context.Background(), testUrl, "GET", "unknown"); err == nil {
+		t.Errorf("Expected Wait to reject an unknown strategy")
+	}
+	if _, err := NewRateLimiter(NewStore(), WithDefaultStrategy("unknown")).GetWaitFor(testUrl, "GET", ""); err == nil {
+		t.Errorf("Expected an unknown default strategy to be rejected")
+	}
+}
+
+func TestRegisterStrategy(t *testing.T) {
+	// Waits a second per request sent in the window, whatever the limits
+	var slowStart StrategyFunc = func(limits []RateLimits, reserved int, clock Clock) time.Duration {
+		var waitTime time.Duration
+		for _, limit := range limits {
+			waitTime = max(waitTime, time.Duration(limit.Counts+reserved)*time.Second)
+		}
+		return waitTime
+	}
+	if err := RegisterStrategy("slow-start", slowStart); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := RegisterStrategy("slow-start", slowStart); err == nil {
+		t.Errorf("Expected a strategy to not be registered twice")
+	}
+	if err := RegisterStrategy(LIMIT_STRATEGY_BURST, slowStart); err == nil {
+		t.Errorf("Expected the built-in strategies to not be replaced")
+	}
+
+	clock := NewFakeClock(time.Now())
+	rl := NewRateLimiter(NewStoreWithClock(clock), WithClock(clock))
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 100, Counts: 3, Duration: time.Minute, LastAt: clock.Now(), WindowStart: clock.Now()},
+	})
+
+	if wait, err := rl.GetWaitFor(testUrl, "GET", "slow-start"); err != nil || wait != 3*time.Second {
+		t.Errorf("Expected the registered strategy to wait 3s, got %v and %v", wait, err)
+	}
+}
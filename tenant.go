@@ -0,0 +1,208 @@
+package ratelimiter
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// TenantQuota is the share of every application limit a tenant gets, as fractions between 0 and 1
+type TenantQuota struct {
+	// Share the tenant is guaranteed, requests of other tenants never use what it leaves unused in a window
+	Guaranteed float64
+	// Share the tenant may use at most, borrowing idle shares of other tenants beyond its guaranteed one (0 means all of it)
+	Max float64
+}
+
+// Accounting of a tenant, see TenantUsage
+type tenantAccount struct {
+	quota    TenantQuota
+	admitted atomic.Uint64
+	borrowed atomic.Uint64
+}
+
+// TenantUsage is the accounting of a tenant, as returned by RateLimiter.TenantUsage
+type TenantUsage struct {
+	Quota TenantQuota
+	// Limits of the tenant by platform, following the application limits scaled to its maximum share
+	// Their counts are the requests of the tenant in the current windows
+	Limits map[string][]RateLimits
+	// Reservations held by the tenant, by platform
+	Reserved map[string]int
+	// Requests admitted since the limiter was created
+	Admitted uint64
+	// Requests admitted beyond the guaranteed share, borrowing idle shares of other tenants
+	Borrowed uint64
+}
+
+// Tenant returns a Requester making requests on behalf of a tenant set up with WithTenant
+// They count against the application and method limits as usual, and against the share of the tenant on top
+func (rl *RateLimiter) Tenant(name string) (*Requester, error) {
+	if _, err := rl.tenant(name); err != nil {
+		return nil, err
+	}
+	return &Requester{rl: rl, tenant: name}, nil
+}
+
+// Returns the accounting of a tenant, or an error if it wasn't set up with WithTenant
+func (rl *RateLimiter) tenant(name string) (*tenantAccount, error) {
+	account, exists := rl.tenants[name]
+	if !exists {
+		return nil, errors.New("unknown tenant: " + name)
+	}
+	return account, nil
+}
+
+// TenantUsage returns the accounting of a tenant set up with WithTenant
+func (rl *RateLimiter) TenantUsage(name string) (TenantUsage, error) {
+	account, err := rl.tenant(name)
+	if err != nil {
+		return TenantUsage{}, err
+	}
+
+	usage := TenantUsage{
+		Quota:    account.quota,
+		Limits:   map[string][]RateLimits{},
+		Reserved: map[string]int{},
+		Admitted: account.admitted.Load(),
+		Borrowed: account.borrowed.Load(),
+	}
+
+	rl.buckets.Range(func(keyRaw, _ any) bool {
+		key := keyRaw.(BucketKey)
+		if key.Scope != LIMIT_TYPE_TENANT || key.Tenant != name {
+			return true
+		}
+		if state, exists := rl.cache.Get(key); exists {
+			usage.Limits[key.Platform] = state.Limits
+			usage.Reserved[key.Platform] = state.Reserved()
+		}
+		return true
+	})
+
+	return usage, nil
+}
+
+// Checks if a request is within the guaranteed share of its tenant, on top of what the tenant already uses
+// Requests without a tenant never are
+func (rl *RateLimiter) withinGuarantee(details *RateLimitDetails, now time.Time) bool {
+	account, exists := rl.tenants[details.TenantName]
+	if !exists {
+		return false
+	}
+
+	appState, _ := rl.cache.Get(details.bucketKey(LIMIT_TYPE_APPLICATION))
+	tenantState, _ := rl.cache.Get(details.bucketKey(LIMIT_TYPE_TENANT))
+	for _, appLimit := range appState.Limits {
+		if tenantUsed(tenantState, appLimit.Duration, now) >= guaranteedCount(appLimit, account.quota) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the number of requests to leave unused in each application window for the guaranteed shares the other tenants haven't used yet
+// Requests beyond the guaranteed share of their tenant, and requests without a tenant, only borrow what is left after them
+func (rl *RateLimiter) unusedGuarantees(details *RateLimitDetails, now time.Time) map[time.Duration]int {
+	appState, _ := rl.cache.Get(details.bucketKey(LIMIT_TYPE_APPLICATION))
+	held := map[time.Duration]int{}
+	for name, account := range rl.tenants {
+		if name == details.TenantName || account.quota.Guaranteed <= 0 {
+			continue
+		}
+
+		tenantState, _ := rl.cache.Get(BucketKey{Platform: details.PlatformName, Tenant: name, Scope: LIMIT_TYPE_TENANT})
+		for _, appLimit := range appState.Limits {
+			held[appLimit.Duration] += max(guaranteedCount(appLimit, account.quota)-tenantUsed(tenantState, appLimit.Duration, now), 0)
+		}
+	}
+	return held
+}
+
+// Returns the number of requests of an application limit guaranteed to a tenant
+func guaranteedCount(appLimit RateLimits, quota TenantQuota) int {
+	return int(math.Floor(float64(appLimit.Limit) * quota.Guaranteed))
+}
+
+// Returns the number of requests a tenant sent or reserved in its window of the given duration
+func tenantUsed(tenantState BucketState, duration time.Duration, now time.Time) int {
+	used := tenantState.Reserved()
+	for _, limit := range tenantState.Limits {
+		if limit.Duration == duration {
+			counts, _ := currentWindow(limit, now)
+			used += counts
+		}
+	}
+	return used
+}
+
+// Counts a reservation made for a tenant, if the request has one
+func (rl *RateLimiter) admitTenant(details *RateLimitDetails, guaranteed bool) {
+	account, exists := rl.tenants[details.TenantName]
+	if !exists {
+		return
+	}
+
+	account.admitted.Add(1)
+	if !guaranteed {
+		account.borrowed.Add(1)
+	}
+}
+
+// Counts a finished request against the bucket of its tenant, if it has one
+func (rl *RateLimiter) countTenant(details *RateLimitDetails, sentAt time.Time) {
+	rl.syncTenant(details, 1, sentAt)
+}
+
+// Installs the limits of the tenant of a request on its bucket before it is checked, so the maximum share also covers requests in flight
+// They follow the current application limits, and are kept up to date as those change
+func (rl *RateLimiter) seedTenantLimits(details *RateLimitDetails) {
+	rl.syncTenant(details, 0, rl.now())
+}
+
+// Brings the bucket of the tenant of a request in line with the application limits, counting the given number of requests sent at the given time
+func (rl *RateLimiter) syncTenant(details *RateLimitDetails, counted int, sentAt time.Time) {
+	account, exists := rl.tenants[details.TenantName]
+	if !exists {
+		return
+	}
+
+	rl.updateLimits(details.bucketKey(LIMIT_TYPE_TENANT), func(current []RateLimits) []RateLimits {
+		appState, _ := rl.cache.Get(details.bucketKey(LIMIT_TYPE_APPLICATION))
+		if len(appState.Limits) == 0 {
+			return current
+		}
+		return tenantLimits(appState.Limits, current, account.quota.Max, counted, sentAt)
+	})
+}
+
+// Returns the limits of a tenant bucket after counting the given number of requests sent at the given time
+// Each follows an application limit, scaled down to the maximum share of the tenant and sharing its window
+func tenantLimits(appLimits []RateLimits, current []RateLimits, share float64, counted int, sentAt time.Time) []RateLimits {
+	limits := make([]RateLimits, len(appLimits))
+
+	for i, appLimit := range appLimits {
+		windowStart := appLimit.ResetAt().Add(-appLimit.Duration)
+		limit := RateLimits{
+			Limit:       max(int(math.Floor(float64(appLimit.Limit)*share)), 1),
+			Duration:    appLimit.Duration,
+			LastAt:      windowStart,
+			WindowStart: windowStart,
+		}
+		for _, currentLimit := range current {
+			if currentLimit.Duration == appLimit.Duration && currentLimit.ResetAt().Equal(appLimit.ResetAt()) {
+				limit.Counts = currentLimit.Counts
+				limit.LastAt = currentLimit.LastAt
+			}
+		}
+		if counted > 0 {
+			limit.Counts += counted
+			limit.LastAt = latest(limit.LastAt, sentAt)
+		}
+		limits[i] = limit
+	}
+
+	return limits
+}
@@ -0,0 +1,124 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Creates a limiter with an application limit of 10 requests per minute and the given tenants
+func newTenantLimiter(t *testing.T, options ...Option) *RateLimiter {
+	clock := NewFakeClock(time.Date(2025, 7, 22, 12, 0, 0, 0, time.UTC))
+	rl := NewRateLimiter(NewStoreWithClock(clock), append(options, WithClock(clock))...)
+	if err := rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 10, Duration: time.Minute, LastAt: clock.Now(), WindowStart: clock.Now()},
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return rl
+}
+
+// Sends requests for a tenant until one is rejected, returns how many were admitted
+func sendTenantRequests(t *testing.T, tenant *Requester, n int) int {
+	for i := 0; i < n; i++ {
+		reservation, _, err := tenant.TryReserve(testUrl, "GET", PRIORITY_NORMAL)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if reservation == nil {
+			return i
+		}
+		if err := reservation.Complete(http.Header{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	return n
+}
+
+func TestTenantQuotas(t *testing.T) {
+	rl := newTenantLimiter(t,
+		WithTenant("a", TenantQuota{Guaranteed: 0.3, Max: 0.6}),
+		WithTenant("b", TenantQuota{Guaranteed: 0.2}),
+	)
+	a, _ := rl.Tenant("a")
+	b, _ := rl.Tenant("b")
+
+	if admitted := sendTenantRequests(t, a, 10); admitted != 6 {
+		t.Errorf("Expected the tenant to stop at its maximum share of 6, got %d", admitted)
+	}
+	if admitted := sendTenantRequests(t, b, 10); admitted != 4 {
+		t.Errorf("Expected the other tenant to get the 4 requests left, got %d", admitted)
+	}
+
+	usage := a.Usage()
+	if usage.Admitted != 6 || usage.Borrowed != 3 {
+		t.Errorf("Expected 6 requests admitted and 3 of them borrowed, got %d and %d", usage.Admitted, usage.Borrowed)
+	}
+	if limits := usage.Limits["NA1"]; len(limits) != 1 || limits[0].Limit != 6 || limits[0].Counts != 6 {
+		t.Errorf("Expected 6 of 6 requests counted on NA1, got %v", limits)
+	}
+
+	if _, err := rl.Tenant("c"); err == nil {
+		t.Errorf("Expected an error for an unknown tenant")
+	}
+}
+
+func TestTenantMaxCoversRequestsInFlight(t *testing.T) {
+	rl := newTenantLimiter(t, WithTenant("a", TenantQuota{Max: 0.5}))
+	a, _ := rl.Tenant("a")
+
+	admitted := 0
+	for i := 0; i < 10; i++ {
+		if reservation, _, _ := a.TryReserve(testUrl, "GET", PRIORITY_NORMAL); reservation != nil {
+			admitted++
+		}
+	}
+	if admitted != 5 {
+		t.Errorf("Expected reservations to stop at the maximum share of 5, got %d", admitted)
+	}
+}
+
+func TestTenantGuaranteesAreKept(t *testing.T) {
+	rl := newTenantLimiter(t,
+		WithTenant("a", TenantQuota{Guaranteed: 0.4}),
+		WithTenant("b", TenantQuota{Guaranteed: 0.3}),
+		WithTenant("c", TenantQuota{Guaranteed: 0.3}),
+	)
+	a, _ := rl.Tenant("a")
+	b, _ := rl.Tenant("b")
+	c, _ := rl.Tenant("c")
+
+	// The tenant bursting first can't borrow the guaranteed shares of the others, even though they are idle
+	if admitted := sendTenantRequests(t, a, 10); admitted != 4 {
+		t.Errorf("Expected the tenant to stop at its guaranteed share of 4, got %d", admitted)
+	}
+	if reservation, _, _ := rl.TryReserve(testUrl, "GET"); reservation != nil {
+		t.Errorf("Expected a request without a tenant to leave the guaranteed shares alone")
+	}
+	if admitted := sendTenantRequests(t, b, 10); admitted != 3 {
+		t.Errorf("Expected the second tenant to get its guaranteed share of 3, got %d", admitted)
+	}
+	if admitted := sendTenantRequests(t, c, 10); admitted != 3 {
+		t.Errorf("Expected the third tenant to get its guaranteed share of 3, got %d", admitted)
+	}
+}
+
+func TestTenantBorrowsIdleShares(t *testing.T) {
+	rl := newTenantLimiter(t,
+		WithTenant("a", TenantQuota{Guaranteed: 0.4}),
+		WithTenant("b", TenantQuota{Guaranteed: 0.3}),
+	)
+	a, _ := rl.Tenant("a")
+	b, _ := rl.Tenant("b")
+
+	// The 3 requests nobody is guaranteed can be borrowed by anyone
+	if admitted := sendTenantRequests(t, a, 10); admitted != 7 {
+		t.Errorf("Expected the tenant to borrow the share nobody is guaranteed, got %d", admitted)
+	}
+	if admitted := sendTenantRequests(t, b, 10); admitted != 3 {
+		t.Errorf("Expected the other tenant to still get its guaranteed share of 3, got %d", admitted)
+	}
+	if usage := a.Usage(); usage.Borrowed != 3 {
+		t.Errorf("Expected 3 borrowed requests, got %d", usage.Borrowed)
+	}
+}
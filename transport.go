@@ -0,0 +1,123 @@
+package ratelimiter
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// Transport is an http.RoundTripper that rate limits every request sent through it
+// It waits for a slot before sending, updates the limits from the response headers and releases the slot if there is no response
+// Requests to URLs that don't match a known API method are sent as-is
+type Transport struct {
+	// Limiter used for every request
+	Limiter *RateLimiter
+	// Transport used to send the requests, defaults to http.DefaultTransport
+	Base http.RoundTripper
+	// Strategy used when waiting, defaults to the default strategy of the Limiter (see RegisterStrategy for custom ones)
+	Strategy LimitStrategy
+	// Priority of the requests sent through the transport, see WaitPriority
+	Priority Priority
+	// Tenant the requests sent through the transport are made for, see WithTenant, empty for none
+	Tenant string
+	// Called when the limits can't be updated from a response, since the response itself is still returned
+	OnError func(error)
+	// Number of times a request answered with a 429 is sent again once the block it caused has lifted, 0 disables retries
+	// Requests with a body are only retried if they have GetBody set, as http.NewRequest does for common body types
+	MaxRetries int
+}
+
+// Creates a new Transport sending requests through base (http.DefaultTransport if nil)
+func NewTransport(limiter *RateLimiter, base http.RoundTripper) *Transport {
+	return &Transport{Limiter: limiter, Base: base}
+}
+
+// RoundTrip waits for a slot, sends the request and updates the limits from the response
+// Cancelling the request context while waiting returns the context error without sending the request
+// The request body is closed on every error, like any RoundTripper does
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	details, err := urlHelper(req.URL.String(), req.Method)
+	if err != nil {
+		return t.base().RoundTrip(req)
+	}
+
+	if t.Tenant != "" {
+		if _, err := t.Limiter.tenant(t.Tenant); err != nil {
+			closeBody(req)
+			return nil, err
+		}
+		details.TenantName = t.Tenant
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.send(req, details)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= t.MaxRetries {
+			return resp, err
+		}
+
+		retry, err := rewindRequest(req)
+		if err != nil {
+			return resp, nil
+		}
+
+		// The 429 already blocked its scope, so the next wait lasts until the block lifts
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		req = retry
+	}
+}
+
+// Sends a single request once a slot is free and updates the limits from its response
+func (t *Transport) send(req *http.Request, details *RateLimitDetails) (*http.Response, error) {
+	reservation, err := t.Limiter.wait(req.Context(), details, t.Strategy, t.Priority)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	reservation.MarkSent()
+	resp, err := t.base().RoundTrip(req)
+	if err != nil {
+		reservation.Cancel()
+		return nil, err
+	}
+
+	if err := reservation.CompleteResponse(resp); err != nil && t.OnError != nil {
+		t.OnError(err)
+	}
+
+	return resp, nil
+}
+
+// Closes the body of a request that is given up on before reaching the base transport, as a RoundTripper has to
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// Returns a copy of the request that can be sent again, with a fresh body if it has one
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	retry := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return retry, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body can't be sent again: " + req.Method + " " + req.URL.String())
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retry.Body = body
+	return retry, nil
+}
+
+// Returns the transport used to send requests
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
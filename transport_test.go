@@ -0,0 +1,127 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransport(t *testing.T) {
+	sendErr := errors.New("connection refused")
+
+	tests := []struct {
+		name          string
+		url           string
+		ctx           context.Context
+		err           error
+		expectSent    bool
+		expectErr     error
+		expectUpdated bool
+	}{
+		{name: "Rate limited request", url: testUrl, ctx: context.Background(), expectSent: true, expectUpdated: true},
+		{name: "Failed request", url: testUrl, ctx: context.Background(), err: sendErr, expectSent: true, expectErr: sendErr},
+		{name: "Unknown endpoint", url: "https://ddragon.leagueoflegends.com/api/versions.json", ctx: context.Background(), expectSent: true},
+		{name: "Cancelled request", url: testUrl, ctx: cancelledContext(), expectErr: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewStore()
+			sent := false
+			transport := NewTransport(NewRateLimiter(store), roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				sent = true
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: req}
+				resp.Header.Set("X-App-Rate-Limit", "100:120")
+				resp.Header.Set("X-App-Rate-Limit-Count", "7:120")
+				return resp, nil
+			}))
+			body := &closeRecorder{Reader: strings.NewReader("payload")}
+			req, _ := http.NewRequestWithContext(tt.ctx, http.MethodGet, tt.url, body)
+			_, err := transport.RoundTrip(req)
+
+			if !errors.Is(err, tt.expectErr) {
+				t.Errorf("Expected error %v, got %v", tt.expectErr, err)
+			}
+			if sent != tt.expectSent {
+				t.Errorf("Expected sent to be %v, got %v", tt.expectSent, sent)
+			}
+
+			state, _ := store.Get(testAppKey)
+			if state.Reserved() != 0 {
+				t.Errorf("Expected the reservation to be released, got %d", state.Reserved())
+			}
+			if !tt.expectSent && !body.closed {
+				t.Errorf("Expected the body of a request that wasn't sent to be closed")
+			}
+			updated := len(state.Limits) == 1 && state.Limits[0].Counts == 7
+			if updated != tt.expectUpdated {
+				t.Errorf("Expected limits updated to be %v, got %v", tt.expectUpdated, state.Limits)
+			}
+		})
+	}
+}
+
+// Records whether a request body was closed
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func cancelledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestTransportRetriesAfterBlock(t *testing.T) {
+	var sentAt []time.Time
+	transport := NewTransport(NewRateLimiter(NewStore()), roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sentAt = append(sentAt, time.Now())
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != "payload" {
+			t.Errorf("Expected the body to be sent with every attempt, got %q", body)
+		}
+
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: req}
+		if len(sentAt) == 1 {
+			resp.StatusCode = http.StatusTooManyRequests
+			resp.Header.Set("Retry-After", "0.05")
+			resp.Header.Set("X-Rate-Limit-Type", "method")
+		}
+		return resp, nil
+	}))
+	transport.MaxRetries = 2
+
+	url := "https://na1.api.riotgames.com/lol/tournament/v5/codes"
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("payload"))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || len(sentAt) != 2 {
+		t.Fatalf("Expected a single retry ending in 200, got %d after %d attempts", resp.StatusCode, len(sentAt))
+	}
+	if gap := sentAt[1].Sub(sentAt[0]); gap < 50*time.Millisecond {
+		t.Errorf("Expected the retry to wait for the Retry-After, got %v", gap)
+	}
+}
@@ -0,0 +1,119 @@
+package ratelimiter
+
+import "time"
+
+// BucketLevel is a level of the bucket tree, see WithBucketTree
+// Every request passes through one bucket on each level it doesn't skip, and is only admitted if all of them have room
+type BucketLevel struct {
+	// Scope of the buckets on the level, their safety margin is set with WithScopeSafetyMargin
+	Scope LimitType
+	// Returns the key of the bucket a request falls into on this level, false if the request skips the level
+	Key func(details *RateLimitDetails) (BucketKey, bool)
+	// Limits of every bucket on the level, for levels whose limits aren't reported by the API
+	// Requests are counted against them locally, nil if the limits come from the responses
+	Limits []RateLimits
+}
+
+// ApplicationLevel is the level of the application limits of each platform, as reported by the API
+func ApplicationLevel() BucketLevel {
+	return BucketLevel{Scope: LIMIT_TYPE_APPLICATION, Key: func(details *RateLimitDetails) (BucketKey, bool) {
+		return details.bucketKey(LIMIT_TYPE_APPLICATION), true
+	}}
+}
+
+// TenantLevel is the level of the tenant shares of each platform, see WithTenant
+// Requests without a tenant skip it
+func TenantLevel() BucketLevel {
+	return BucketLevel{Scope: LIMIT_TYPE_TENANT, Key: func(details *RateLimitDetails) (BucketKey, bool) {
+		return details.bucketKey(LIMIT_TYPE_TENANT), details.TenantName != ""
+	}}
+}
+
+// ServiceLevel is a level with the given limits for each service of each platform
+// The API doesn't report service limits, so they have to be known upfront
+func ServiceLevel(limits []RateLimits) BucketLevel {
+	return BucketLevel{Scope: LIMIT_TYPE_SERVICE, Limits: limits, Key: func(details *RateLimitDetails) (BucketKey, bool) {
+		return details.bucketKey(LIMIT_TYPE_SERVICE), true
+	}}
+}
+
+// MethodLevel is the level of the method limits of each platform, as reported by the API
+func MethodLevel() BucketLevel {
+	return BucketLevel{Scope: LIMIT_TYPE_METHOD, Key: func(details *RateLimitDetails) (BucketKey, bool) {
+		return details.bucketKey(LIMIT_TYPE_METHOD), true
+	}}
+}
+
+// LabelLevel is a level with the given limits for each value of a request label on each platform, e.g. a level per end user
+// Its scope is the name of the label, requests without the label skip it, see RateLimiter.Requester
+func LabelLevel(name string, limits []RateLimits) BucketLevel {
+	return BucketLevel{Scope: LimitType(name), Limits: limits, Key: func(details *RateLimitDetails) (BucketKey, bool) {
+		label := details.Labels[name]
+		return BucketKey{Platform: details.PlatformName, Label: label, Scope: LimitType(name)}, label != ""
+	}}
+}
+
+// Returns the levels of the default bucket tree: application, then tenant, then method
+func defaultBucketTree() []BucketLevel {
+	return []BucketLevel{ApplicationLevel(), TenantLevel(), MethodLevel()}
+}
+
+// WithBucketTree sets the levels of the bucket tree, from the root down to the leaves
+// e.g. WithBucketTree(ApplicationLevel(), TenantLevel(), ServiceLevel(serviceLimits), MethodLevel())
+// The default is ApplicationLevel(), TenantLevel() and MethodLevel()
+// Limits reported by the API are always learned, but only those of levels in the tree are enforced
+func WithBucketTree(levels ...BucketLevel) Option {
+	return func(rl *RateLimiter) {
+		rl.tree = levels
+	}
+}
+
+// Returns the checks for the buckets a request passes through, from the root of the tree down, each with the safety margin of its scope
+// The bucket of a tenant follows the application limits, so it gets the margin of the application scope
+func (rl *RateLimiter) bucketChecks(details *RateLimitDetails) []BucketCheck {
+	checks := make([]BucketCheck, 0, len(rl.tree))
+	for _, level := range rl.tree {
+		key, ok := level.Key(details)
+		if !ok {
+			continue
+		}
+
+		scope := level.Scope
+		if scope == LIMIT_TYPE_TENANT {
+			scope = LIMIT_TYPE_APPLICATION
+		}
+		checks = append(checks, BucketCheck{Key: key, Margin: rl.scopeSafetyMargin(scope)})
+	}
+	return checks
+}
+
+// Returns the keys of the buckets a request passes through, from the root of the tree down
+// Reservations for the request are held on every one of them
+func (rl *RateLimiter) bucketPath(details *RateLimitDetails) []BucketKey {
+	checks := rl.bucketChecks(details)
+	keys := make([]BucketKey, len(checks))
+	for i, check := range checks {
+		keys[i] = check.Key
+	}
+	return keys
+}
+
+// Installs the limits of the levels that have their own on the buckets of a request that don't have them yet
+func (rl *RateLimiter) seedLevelLimits(details *RateLimitDetails) {
+	now := rl.now()
+	for _, level := range rl.tree {
+		if key, ok := level.Key(details); ok && len(level.Limits) > 0 {
+			rl.seedLimits(key, level.Limits, now)
+		}
+	}
+}
+
+// Counts a finished request against the buckets of the levels that have their own limits
+func (rl *RateLimiter) countLevels(details *RateLimitDetails, sentAt time.Time) {
+	for _, level := range rl.tree {
+		if key, ok := level.Key(details); ok && len(level.Limits) > 0 {
+			rl.track(key)
+			rl.mergeLimits(key, nil, sentAt)
+		}
+	}
+}
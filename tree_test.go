@@ -0,0 +1,139 @@
+package ratelimiter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBucketPath(t *testing.T) {
+	serviceLimits := []RateLimits{{Limit: 100, Duration: time.Minute}}
+	userKey := BucketKey{Platform: "NA1", Label: "1234", Scope: "user"}
+	testTenantKey := BucketKey{Platform: "NA1", Tenant: "a", Scope: LIMIT_TYPE_TENANT}
+
+	tests := []struct {
+		name     string
+		tree     []BucketLevel
+		tenant   string
+		labels   map[string]string
+		expected []BucketKey
+	}{
+		{name: "Default", expected: []BucketKey{testAppKey, testMethodKey}},
+		{name: "Default with a tenant", tenant: "a", expected: []BucketKey{testAppKey, testTenantKey, testMethodKey}},
+		{
+			name:     "Nested levels",
+			tree:     []BucketLevel{ApplicationLevel(), TenantLevel(), ServiceLevel(serviceLimits), LabelLevel("user", nil), MethodLevel()},
+			tenant:   "a",
+			labels:   map[string]string{"user": "1234"},
+			expected: []BucketKey{testAppKey, testTenantKey, testServiceKey, userKey, testMethodKey},
+		},
+		{
+			name:     "Skipped label",
+			tree:     []BucketLevel{ApplicationLevel(), LabelLevel("user", nil)},
+			expected: []BucketKey{testAppKey},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := []Option{WithTenant("a", TenantQuota{Guaranteed: 1})}
+			if tt.tree != nil {
+				options = append(options, WithBucketTree(tt.tree...))
+			}
+			rl := NewRateLimiter(NewStore(), options...)
+
+			details, _ := urlHelper(testUrl, "GET")
+			details.TenantName, details.Labels = tt.tenant, tt.labels
+			if path := rl.bucketPath(details); !slices.Equal(path, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, path)
+			}
+		})
+	}
+}
+
+func TestLabelLevel(t *testing.T) {
+	store := NewStore()
+	rl := NewRateLimiter(store, WithBucketTree(ApplicationLevel(), LabelLevel("user", []RateLimits{{Limit: 2, Duration: time.Minute}})))
+	alice := rl.Requester(map[string]string{"user": "alice"})
+	bob := rl.Requester(map[string]string{"user": "bob"})
+
+	for i := 0; i < 2; i++ {
+		reservation, _, err := alice.TryReserve(testUrl, "GET", PRIORITY_NORMAL)
+		if err != nil || reservation == nil {
+			t.Fatalf("Expected request %d of the user to be admitted, got %v", i+1, err)
+		}
+		if state, _ := store.Get(testAppKey); state.Reserved() != 1 {
+			t.Errorf("Expected the reservation to be held on the application bucket too, got %d", state.Reserved())
+		}
+		reservation.Complete(http.Header{})
+	}
+
+	if reservation, wait, _ := alice.TryReserve(testUrl, "GET", PRIORITY_NORMAL); reservation != nil || wait <= 0 {
+		t.Errorf("Expected the user to be limited, got %v", wait)
+	}
+	if reservation, _, _ := bob.TryReserve(testUrl, "GET", PRIORITY_NORMAL); reservation == nil {
+		t.Errorf("Expected another user to have its own limits")
+	}
+}
+
+func TestLevelSafetyMargin(t *testing.T) {
+	rl := NewRateLimiter(NewStore(), WithSafetyMargin(SafetyMargin{Percent: 50}),
+		WithBucketTree(ApplicationLevel(), ServiceLevel([]RateLimits{{Limit: 10, Duration: time.Minute}})))
+
+	admitted := 0
+	for i := 0; i < 10; i++ {
+		if reservation, _, _ := rl.TryReserve(testUrl, "GET"); reservation != nil {
+			admitted++
+		}
+	}
+	if admitted != 5 {
+		t.Errorf("Expected the margin to leave half of the service limit unused, got %d", admitted)
+	}
+}
+
+func TestTreeWithoutMethodLevel(t *testing.T) {
+	rl := NewRateLimiter(NewStore(), WithBucketTree(ApplicationLevel()))
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_METHOD, []RateLimits{
+		{Limit: 1, Counts: 1, Duration: time.Minute, LastAt: time.Now(), WindowStart: time.Now()},
+	})
+
+	if reservation, _, _ := rl.TryReserve(testUrl, "GET"); reservation == nil {
+		t.Errorf("Expected method limits outside of the tree to not be enforced")
+	}
+}
+
+func TestLabelBucketsAreForgotten(t *testing.T) {
+	clock := NewFakeClock(time.Date(2025, 7, 22, 12, 0, 0, 0, time.UTC))
+	rl := NewRateLimiter(NewStoreWithClock(clock), WithClock(clock),
+		WithBucketTree(ApplicationLevel(), LabelLevel("user", []RateLimits{{Limit: 1, Duration: time.Minute}})))
+
+	for i := 0; i < 10; i++ {
+		user := rl.Requester(map[string]string{"user": strconv.Itoa(i)})
+		reservation, err := user.Wait(context.Background(), testUrl, "GET", LIMIT_STRATEGY_BURST, PRIORITY_NORMAL)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		reservation.Complete(http.Header{})
+	}
+
+	countKeys := func(m *sync.Map) int {
+		count := 0
+		m.Range(func(_, _ any) bool { count++; return true })
+		return count
+	}
+	if queues := countKeys(&rl.queues); queues != 0 {
+		t.Errorf("Expected the queues to be dropped once nobody waits, got %d", queues)
+	}
+
+	// The limits of the users expire after two of their windows, and their buckets are forgotten with them
+	clock.Advance(3 * time.Minute)
+	rl.SaveSnapshot(io.Discard)
+	if buckets := countKeys(&rl.buckets); buckets != 0 {
+		t.Errorf("Expected the expired buckets to be forgotten, got %d", buckets)
+	}
+}
@@ -0,0 +1,112 @@
+package ratelimiter
+
+import (
+	"context"
+	"time"
+)
+
+// Wait blocks until a request to the URL and method may be sent, claiming a slot for it
+// The slot is claimed atomically before sleeping, so concurrent callers never get handed the same one
+// Returns early with the context error on cancellation or deadline, releasing the slot
+// An empty strategy uses the default one of the limiter, unknown strategies are rejected
+// Complete or Cancel the returned Reservation once the request is done
+func (rl *RateLimiter) Wait(ctx context.Context, url string, method string, strategy LimitStrategy) (*Reservation, error) {
+	details, err := urlHelper(url, method)
+	if err != nil {
+		return nil, err
+	}
+
+	return rl.wait(ctx, details, strategy, PRIORITY_NORMAL)
+}
+
+// Blocks until a request with the given details and priority may be sent, claiming a slot for it
+func (rl *RateLimiter) wait(ctx context.Context, details *RateLimitDetails, name LimitStrategy, priority Priority) (*Reservation, error) {
+	strategy, err := rl.strategy(name)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := rl.bucketPath(details)
+	rl.track(keys...)
+	rl.seedDefaultLimits(details)
+
+	// Join the queues of the buckets, so waiters get their slots in order of priority and arrival
+	entry, leave := rl.joinQueues(details, queueRank(priority, rl.withinGuarantee(details, rl.now())))
+	defer leave()
+
+	// Claim a slot as soon as the limits have room for it
+	var lease Lease
+	var guaranteed bool
+	for {
+		rl.reclaim(keys...)
+
+		now := rl.now()
+		if serviceWait := rl.serviceWait(details, now); serviceWait > 0 {
+			rl.notifyWait(details, serviceWait)
+			if err := rl.sleep(ctx, serviceWait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Sleep until the slot scheduled for this waiter, so waiters wake up one after another
+		if sendAt := rl.scheduledAt(details, entry, now); sendAt.After(now) {
+			rl.notifyWait(details, sendAt.Sub(now))
+			if err := rl.sleep(ctx, sendAt.Sub(now)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		guaranteed = rl.withinGuarantee(details, now)
+		lease = rl.newLease()
+		waitTime, reserved := rl.cache.CheckAndReserve(rl.priorityChecks(details, priority, guaranteed), lease, rl.now())
+		if reserved {
+			break
+		}
+
+		rl.notifyWait(details, waitTime)
+		if err := rl.sleep(ctx, waitTime); err != nil {
+			return nil, err
+		}
+	}
+
+	// The slot is claimed, so the waiters behind this one move up
+	leave()
+	rl.admitTenant(details, guaranteed)
+	reservation := newReservation(rl, details, lease)
+
+	// Hold the slot for as long as the strategy asks, e.g. for the pace the remaining limits allow when spreading out requests
+	waitTime := rl.waitFor(details, strategy, 1)
+	rl.notifyWait(details, waitTime)
+	if err := rl.sleep(ctx, waitTime); err != nil {
+		reservation.Cancel()
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		reservation.Cancel()
+		return nil, err
+	}
+
+	// The request goes out right after this returns, not when the slot was claimed
+	reservation.MarkSent()
+	return reservation, nil
+}
+
+// Sleeps on the clock of the limiter for the given duration or until the context is done, whichever comes first
+func (rl *RateLimiter) sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := rl.clock.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,91 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWaitClaimsDistinctSlots(t *testing.T) {
+	store := NewStore()
+	rl := NewRateLimiter(store)
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 5, Counts: 0, Duration: time.Minute, LastAt: time.Now()},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	admitted := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := rl.Wait(ctx, testUrl, "GET", LIMIT_STRATEGY_BURST)
+			if err == nil {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			} else if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if admitted != 5 {
+		t.Errorf("Expected exactly 5 requests to be admitted, got %d", admitted)
+	}
+
+	if state, _ := store.Get(testAppKey); state.Reserved() != 5 {
+		t.Errorf("Expected the 5 admitted requests to hold reservations, got %d", state.Reserved())
+	}
+}
+
+func TestWaitReleasesOnCancel(t *testing.T) {
+	store := NewStore()
+	rl := NewRateLimiter(store)
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 2, Counts: 0, Duration: time.Minute, LastAt: time.Now()},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// With the spread strategy the first slot is claimed, then held while waiting for the pace
+	if _, err := rl.Wait(ctx, testUrl, "GET", LIMIT_STRATEGY_SPREAD); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+
+	if state, _ := store.Get(testAppKey); state.Reserved() != 0 {
+		t.Errorf("Expected the reservation to be released, got %d", state.Reserved())
+	}
+}
+
+func TestWaitMarksSentOnReturn(t *testing.T) {
+	clock := NewFakeClock(time.Date(2025, 7, 22, 12, 0, 0, 0, time.UTC))
+	rl := NewRateLimiter(NewStoreWithClock(clock), WithClock(clock))
+	rl.UpdateRateLimits(testUrl, "GET", LIMIT_TYPE_APPLICATION, []RateLimits{
+		{Limit: 100, Counts: 90, Duration: 2 * time.Minute, LastAt: clock.Now(), WindowStart: clock.Now()},
+	})
+
+	done := make(chan *Reservation)
+	go func() {
+		reservation, err := rl.Wait(context.Background(), testUrl, "GET", LIMIT_STRATEGY_SPREAD)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		done <- reservation
+	}()
+
+	// The claimed slot is held for the pace of the 10 requests left in 2 minutes
+	clock.BlockUntilTimers(1)
+	clock.Advance(12 * time.Second)
+	if reservation := <-done; reservation != nil && !reservation.sentTime().Equal(clock.Now()) {
+		t.Errorf("Expected the request to be stamped when Wait returned at %v, got %v", clock.Now(), reservation.sentTime())
+	}
+}